@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/signer"
+)
+
+// bucketConfigs 可以从源 bucket 复制到目标 bucket 的配置
+var bucketConfigs = []string{"policy", "lifecycle", "versioning", "encryption", "cors", "notification", "tags"}
+
+// parseBucketConfigs 解析逗号分隔的配置列表，all 表示全部
+func parseBucketConfigs(s string) ([]string, error) {
+	var configs []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			continue
+		case name == "all":
+			return bucketConfigs, nil
+		case !contains(bucketConfigs, name):
+			return nil, fmt.Errorf("invalid bucket config %q, must be one of: all, %s", name, strings.Join(bucketConfigs, ", "))
+		}
+		configs = append(configs, name)
+	}
+	return configs, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isConfigNotFound 源 bucket 没有设置这项配置
+func isConfigNotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.StatusCode == http.StatusNotFound && resp.Code != "NoSuchBucket"
+}
+
+// createBucket 目标 bucket 不存在时创建，源 bucket 开启了对象锁定时目标也开启，并复制默认保留策略
+func createBucket(ctx context.Context, src *minio.Client, srcBucket string, dst *minio.Client, dstBucket, region string) error {
+	exists, err := dst.BucketExists(ctx, dstBucket)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	objectLock, mode, validity, unit, err := src.GetObjectLockConfig(ctx, srcBucket)
+	if err != nil && !isConfigNotFound(err) {
+		return fmt.Errorf("get object lock config of %s: %w", srcBucket, err)
+	}
+	locking := objectLock == "Enabled"
+	if err := dst.MakeBucket(ctx, dstBucket, minio.MakeBucketOptions{Region: region, ObjectLocking: locking}); err != nil {
+		return fmt.Errorf("create bucket %s: %w", dstBucket, err)
+	}
+	log.Printf("bucket %s created, object lock: %t\n", dstBucket, locking)
+	if locking && mode != nil {
+		if err := dst.SetObjectLockConfig(ctx, dstBucket, mode, validity, unit); err != nil {
+			return fmt.Errorf("set object lock config of %s: %w", dstBucket, err)
+		}
+	}
+	return nil
+}
+
+// copyBucketConfigs 把源 bucket 的配置复制到目标 bucket，源没有设置的配置跳过
+// 事件通知引用的 ARN、加密使用的 KMS key 只存在于源集群时设置会失败，这两项失败时只告警
+func copyBucketConfigs(ctx context.Context, src *minio.Client, srcBucket string, srcOptions *minio.Options, dst *minio.Client, dstBucket string, dstOptions *minio.Options, configs []string) error {
+	for _, name := range configs {
+		copied, err := copyBucketConfig(ctx, src, srcBucket, srcOptions, dst, dstBucket, dstOptions, name)
+		if err != nil && copied && (name == "notification" || name == "encryption") {
+			log.Printf("warning: set %s config of bucket %s failed, skip: %s\n", name, dstBucket, err)
+			continue
+		}
+		if err != nil && (copied || !isConfigNotFound(err)) {
+			return fmt.Errorf("copy %s config of bucket %s: %w", name, srcBucket, err)
+		}
+		if !copied {
+			log.Printf("bucket %s has no %s config, skip\n", srcBucket, name)
+			continue
+		}
+		log.Printf("%s config of bucket %s copied to %s\n", name, srcBucket, dstBucket)
+	}
+	return nil
+}
+
+// copyBucketConfig 复制一项配置，读取源配置出错或源配置为空时 copied 为 false
+// cors 没有对应的 minio-go 接口，直接发送签名请求
+func copyBucketConfig(ctx context.Context, src *minio.Client, srcBucket string, srcOptions *minio.Options, dst *minio.Client, dstBucket string, dstOptions *minio.Options, name string) (bool, error) {
+	switch name {
+	case "policy":
+		policy, err := src.GetBucketPolicy(ctx, srcBucket)
+		if err != nil || policy == "" {
+			return false, err
+		}
+		return true, dst.SetBucketPolicy(ctx, dstBucket, policy)
+	case "lifecycle":
+		config, err := src.GetBucketLifecycle(ctx, srcBucket)
+		if err != nil || config.Empty() {
+			return false, err
+		}
+		return true, dst.SetBucketLifecycle(ctx, dstBucket, config)
+	case "versioning":
+		config, err := src.GetBucketVersioning(ctx, srcBucket)
+		if err != nil || config.Status == "" {
+			return false, err
+		}
+		return true, dst.SetBucketVersioning(ctx, dstBucket, config)
+	case "encryption":
+		config, err := src.GetBucketEncryption(ctx, srcBucket)
+		if err != nil {
+			return false, err
+		}
+		return true, dst.SetBucketEncryption(ctx, dstBucket, config)
+	case "cors":
+		config, err := bucketSubresource(ctx, src, srcOptions, srcBucket, http.MethodGet, "cors", nil)
+		if err != nil {
+			return false, err
+		}
+		_, err = bucketSubresource(ctx, dst, dstOptions, dstBucket, http.MethodPut, "cors", config)
+		return true, err
+	case "notification":
+		config, err := src.GetBucketNotification(ctx, srcBucket)
+		if err != nil || len(config.LambdaConfigs)+len(config.TopicConfigs)+len(config.QueueConfigs) == 0 {
+			return false, err
+		}
+		return true, dst.SetBucketNotification(ctx, dstBucket, config)
+	case "tags":
+		config, err := src.GetBucketTagging(ctx, srcBucket)
+		if err != nil || len(config.ToMap()) == 0 {
+			return false, err
+		}
+		return true, dst.SetBucketTagging(ctx, dstBucket, config)
+	default:
+		return false, fmt.Errorf("unsupported bucket config: %s", name)
+	}
+}
+
+// bucketSubresource 对 bucket 的子资源（如 ?cors）发送签名请求，返回响应内容
+func bucketSubresource(ctx context.Context, client *minio.Client, options *minio.Options, bucket, method, subresource string, body []byte) ([]byte, error) {
+	creds, err := options.Creds.Get()
+	if err != nil {
+		return nil, err
+	}
+	region := options.Region
+	if region == "" {
+		if region, err = client.GetBucketLocation(ctx, bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	u := *client.EndpointURL()
+	if options.BucketLookup == minio.BucketLookupDNS {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/"
+	} else {
+		u.Path = "/" + bucket + "/"
+	}
+	u.RawQuery = url.QueryEscape(subresource) + "="
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	if body != nil {
+		md5sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]))
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	req = signer.SignV4(*req, creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken, region)
+
+	transport := options.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		errResp := minio.ErrorResponse{StatusCode: resp.StatusCode}
+		// 错误响应是 S3 的 <Error> xml，解析失败时只保留状态码
+		_ = xml.Unmarshal(data, &errResp)
+		if errResp.Code == "" {
+			errResp.Code = resp.Status
+		}
+		return nil, errResp
+	}
+	return data, nil
+}
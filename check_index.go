@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/minio/minio-go/v7"
+	"github.com/urfave/cli/v2"
+)
+
+var checkIndex = &cli.Command{
+	Name:  "check-index",
+	Usage: "check the miner sector index against the bucket contents",
+	Flags: append([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:     "storage",
+			EnvVars:  []string{"storage"},
+			Required: true,
+			Usage:    "storage uuid and the bucket backing it, uuid=bucket[/prefix], can be repeated",
+		},
+		&cli.StringFlag{
+			Name:    "miner",
+			EnvVars: []string{"miner"},
+			Usage:   "only check sectors of this miner, f01000 or t01000",
+		},
+		&cli.StringFlag{
+			Name:     "rpc",
+			EnvVars:  []string{"rpc"},
+			Required: true,
+			Usage:    "miner rpc, http://localhost:2345/rpc/v0",
+		},
+		&cli.StringFlag{
+			Name:     "token",
+			EnvVars:  []string{"token"},
+			Required: true,
+			Usage:    "miner admin token",
+		},
+		&cli.DurationFlag{
+			Name:    "rpc_timeout",
+			EnvVars: []string{"rpc_timeout"},
+			Value:   30 * time.Second,
+			Usage:   "timeout of each miner rpc request",
+		},
+		&cli.IntFlag{
+			Name:    "rpc_retries",
+			EnvVars: []string{"rpc_retries"},
+			Value:   3,
+			Usage:   "retries of miner rpc requests on network errors and 5xx responses",
+		},
+		&cli.BoolFlag{
+			Name:    "repair",
+			EnvVars: []string{"repair"},
+			Usage:   "declare files that are present but undeclared, drop declarations whose files are missing",
+		},
+	}, append(endpointFlags("src"), credentialFlags("src")...)...),
+	UsageText: `
+only the storages given by --storage are checked, other storages in the index are ignored.
+duplicates (the same sector file present in more than one storage) are reported but never repaired.
+exit code is 1 when problems are found and not repaired.
+`,
+	Before: remoteBefore("src"),
+	Action: checkIndexAction,
+}
+
+// sectorFileKey 标识一个扇区文件（cache 目录整体算一个）
+type sectorFileKey struct {
+	sector   sectorID
+	fileType int
+}
+
+func (k sectorFileKey) String() string {
+	dir := "unknown"
+	for name, ft := range sectorFileTypeDirs {
+		if ft == k.fileType {
+			dir = name
+		}
+	}
+	return fmt.Sprintf("%s sector %d-%d", dir, k.sector.Miner, k.sector.Number)
+}
+
+// backingStorage 一个存储 uuid 对应的 bucket 和前缀
+type backingStorage struct {
+	uuid   string
+	bucket string
+	prefix string
+}
+
+func checkIndexAction(cctx *cli.Context) error {
+	var storages []backingStorage
+	for _, s := range cctx.StringSlice("storage") {
+		uuid, location, ok := strings.Cut(s, "=")
+		bucket, prefix, _ := strings.Cut(location, "/")
+		if !ok || uuid == "" || bucket == "" {
+			return fmt.Errorf("invalid storage %q, must be uuid=bucket[/prefix]", s)
+		}
+		storages = append(storages, backingStorage{uuid: uuid, bucket: bucket, prefix: prefix})
+	}
+
+	var miner uint64
+	filterMiner := cctx.IsSet("miner")
+	if filterMiner {
+		addr, err := address.NewFromString(cctx.String("miner"))
+		if err != nil {
+			return err
+		}
+		miner, err = address.IDFromAddress(addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	lotusApi = newLotusClient(cctx.String("rpc"), cctx.String("token"), cctx.Duration("rpc_timeout"), cctx.Int("rpc_retries"))
+	ctx := context.Background()
+
+	src_endpoint, srcOptions, err := newS3Options(cctx, "src")
+	if err != nil {
+		return err
+	}
+	client, err := minio.New(src_endpoint, srcOptions)
+	if err != nil {
+		return err
+	}
+
+	list, err := lotusApi.StorageList(ctx)
+	if err != nil {
+		return err
+	}
+
+	// 每个存储实际存在的扇区文件
+	present := make(map[string]map[sectorFileKey]bool)
+	// 扇区文件出现在哪些存储中，用于检查重复
+	locations := make(map[sectorFileKey][]string)
+	for _, storage := range storages {
+		files := make(map[sectorFileKey]bool)
+		for obj := range client.ListObjects(ctx, storage.bucket, minio.ListObjectsOptions{Prefix: storage.prefix, Recursive: true}) {
+			if obj.Err != nil {
+				return fmt.Errorf("ListObjects error: %w", obj.Err)
+			}
+			file, err := parseSectorKey(obj.Key)
+			if err != nil {
+				continue
+			}
+			if filterMiner && file.Sector.Miner != miner {
+				continue
+			}
+			key := sectorFileKey{sector: file.Sector, fileType: file.FileType}
+			if !files[key] {
+				files[key] = true
+				locations[key] = append(locations[key], storage.uuid)
+			}
+		}
+		present[storage.uuid] = files
+		log.Printf("storage %s: %d sector files in bucket %s\n", storage.uuid, len(files), storage.bucket)
+	}
+
+	var problems, repaired int
+	for _, storage := range storages {
+		declared := make(map[sectorFileKey]bool)
+		for _, decl := range list[storage.uuid] {
+			if filterMiner && decl.Miner != miner {
+				continue
+			}
+			// 一个 Decl 的 SectorFileType 可能是多个类型的组合
+			for _, ft := range sectorFileTypeDirs {
+				if decl.SectorFileType&ft != 0 {
+					declared[sectorFileKey{sector: sectorID{Miner: decl.Miner, Number: decl.Number}, fileType: ft}] = true
+				}
+			}
+		}
+
+		for _, key := range sortedSectorFileKeys(declared) {
+			if present[storage.uuid][key] {
+				continue
+			}
+			problems++
+			fmt.Printf("missing     %s declared in %s but not found in bucket %s\n", key, storage.uuid, storage.bucket)
+			if cctx.Bool("repair") {
+				if err := lotusApi.StorageDropSector(ctx, storage.uuid, key.sector, key.fileType); err != nil {
+					log.Printf("drop %s in %s failed: %s\n", key, storage.uuid, err)
+					continue
+				}
+				log.Printf("drop %s in %s\n", key, storage.uuid)
+				repaired++
+			}
+		}
+
+		for _, key := range sortedSectorFileKeys(present[storage.uuid]) {
+			if declared[key] {
+				continue
+			}
+			problems++
+			fmt.Printf("undeclared  %s found in bucket %s but not declared in %s\n", key, storage.bucket, storage.uuid)
+			if cctx.Bool("repair") {
+				if err := lotusApi.StorageDeclareSector(ctx, storage.uuid, key.sector, key.fileType, true); err != nil {
+					log.Printf("declare %s in %s failed: %s\n", key, storage.uuid, err)
+					continue
+				}
+				log.Printf("declare %s in %s\n", key, storage.uuid)
+				repaired++
+			}
+		}
+	}
+
+	for _, key := range sortedSectorFileKeys(locationsSet(locations)) {
+		if len(locations[key]) > 1 {
+			problems++
+			fmt.Printf("duplicate   %s found in %s\n", key, strings.Join(locations[key], ", "))
+		}
+	}
+
+	fmt.Printf("problems: %d, repaired: %d\n", problems, repaired)
+	if problems > repaired {
+		return cli.Exit(fmt.Sprintf("%d problems not repaired", problems-repaired), 1)
+	}
+	return nil
+}
+
+func locationsSet(m map[sectorFileKey][]string) map[sectorFileKey]bool {
+	set := make(map[sectorFileKey]bool, len(m))
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
+
+func sortedSectorFileKeys(m map[sectorFileKey]bool) []sectorFileKey {
+	keys := make([]sectorFileKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.sector.Miner != b.sector.Miner {
+			return a.sector.Miner < b.sector.Miner
+		}
+		if a.sector.Number != b.sector.Number {
+			return a.sector.Number < b.sector.Number
+		}
+		return a.fileType < b.fileType
+	})
+	return keys
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// expectedDigest 描述一条记录预期的校验值
+// 支持 sha256:<hex>、md5:<hex>，以及 .car 文件的 piece CID（可带 commp: 前缀）
+type expectedDigest struct {
+	algo string
+	sum  []byte
+	raw  string
+}
+
+func parseDigest(s string) (*expectedDigest, error) {
+	algo, value, found := strings.Cut(s, ":")
+	if !found {
+		algo, value = "commp", s
+	}
+	switch strings.ToLower(algo) {
+	case "sha256":
+		sum, err := hex.DecodeString(value)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 checksum: %s", s)
+		}
+		return &expectedDigest{algo: "sha256", sum: sum, raw: s}, nil
+	case "md5":
+		sum, err := hex.DecodeString(value)
+		if err != nil || len(sum) != md5.Size {
+			return nil, fmt.Errorf("invalid md5 checksum: %s", s)
+		}
+		return &expectedDigest{algo: "md5", sum: sum, raw: s}, nil
+	case "commp":
+		sum, err := pieceCIDToCommP(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid piece cid %s: %w", value, err)
+		}
+		return &expectedDigest{algo: "commp", sum: sum, raw: s}, nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum type: %s, must be one of: sha256, md5, commp", algo)
+	}
+}
+
+// verifyWriter 在数据流经时计算校验值和长度，传输完成后调用 Verify 比对
+// digest 为 nil 或 size 小于 0 时对应项不做检查
+type verifyWriter struct {
+	digest *expectedDigest
+	size   int64
+
+	n     int64
+	h     hash.Hash
+	commp *commpWriter
+}
+
+func newVerifyWriter(digest *expectedDigest, size int64) *verifyWriter {
+	v := &verifyWriter{digest: digest, size: size}
+	if digest != nil {
+		switch digest.algo {
+		case "sha256":
+			v.h = sha256.New()
+		case "md5":
+			v.h = md5.New()
+		case "commp":
+			v.commp = newCommpWriter()
+		}
+	}
+	return v
+}
+
+func (v *verifyWriter) Write(p []byte) (int, error) {
+	v.n += int64(len(p))
+	if v.h != nil {
+		v.h.Write(p)
+	}
+	if v.commp != nil {
+		v.commp.Write(p)
+	}
+	return len(p), nil
+}
+
+func (v *verifyWriter) Verify() error {
+	if v.size >= 0 && v.n != v.size {
+		return fmt.Errorf("size mismatch: expected %d, got %d", v.size, v.n)
+	}
+	if v.digest == nil {
+		return nil
+	}
+
+	var sum []byte
+	if v.commp != nil {
+		commp, _, err := v.commp.Sum()
+		if err != nil {
+			return err
+		}
+		sum = commp
+	} else {
+		sum = v.h.Sum(nil)
+	}
+	if !bytes.Equal(sum, v.digest.sum) {
+		return fmt.Errorf("%s mismatch: expected %s, got %s", v.digest.algo, v.digest.raw, v.formatSum(sum))
+	}
+	return nil
+}
+
+func (v *verifyWriter) formatSum(sum []byte) string {
+	if v.digest.algo != "commp" {
+		return v.digest.algo + ":" + hex.EncodeToString(sum)
+	}
+	c, err := commPToPieceCID(sum)
+	if err != nil {
+		return hex.EncodeToString(sum)
+	}
+	return c.String()
+}
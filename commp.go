@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// commpWriter 流式计算 Filecoin piece commitment (CommP)
+// 数据按 127 字节一组做 fr32 填充成 128 字节，再以 32 字节为叶子构建 sha256-trunc254 merkle 树
+type commpWriter struct {
+	buf    []byte
+	size   uint64
+	leaves uint64
+	// stack[i] 保存第 i 层尚未配对的节点
+	stack [][]byte
+}
+
+func newCommpWriter() *commpWriter {
+	return &commpWriter{buf: make([]byte, 0, 127)}
+}
+
+func (w *commpWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	w.size += uint64(n)
+	for len(p) > 0 {
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		if len(w.buf) == cap(w.buf) {
+			w.consumeChunk(w.buf)
+			w.buf = w.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Sum 返回 CommP 以及填充后的 piece 大小
+func (w *commpWriter) Sum() ([]byte, uint64, error) {
+	if w.size < 65 {
+		return nil, 0, fmt.Errorf("commp: payload of %d bytes is too small, need at least 65", w.size)
+	}
+	if len(w.buf) > 0 {
+		chunk := make([]byte, 127)
+		copy(chunk, w.buf)
+		w.consumeChunk(chunk)
+		w.buf = w.buf[:0]
+	}
+
+	// 用全零子树补齐到 2 的幂
+	target := uint64(1) << bits.Len64(w.leaves-1)
+	if target < 4 {
+		target = 4
+	}
+	for w.leaves < target {
+		level := bits.TrailingZeros64(w.leaves)
+		w.pushNode(zeroCommitment(level), level)
+		w.leaves += uint64(1) << level
+	}
+
+	root := w.stack[len(w.stack)-1]
+	return root, target * 32, nil
+}
+
+func (w *commpWriter) consumeChunk(in []byte) {
+	var out [128]byte
+	fr32Expand(in, out[:])
+	for i := 0; i < 4; i++ {
+		w.pushNode(out[i*32:(i+1)*32], 0)
+		w.leaves++
+	}
+}
+
+// pushNode 把一个节点放入 level 层，能配对时向上合并
+func (w *commpWriter) pushNode(node []byte, level int) {
+	node = append([]byte(nil), node...)
+	for {
+		if len(w.stack) <= level {
+			w.stack = append(w.stack, nil)
+		}
+		if w.stack[level] == nil {
+			w.stack[level] = node
+			return
+		}
+		node = hashNodes(w.stack[level], node)
+		w.stack[level] = nil
+		level++
+	}
+}
+
+// fr32Expand 把 127 字节按 254 bit 一组展开为 128 字节，每组高 2 bit 置零
+func fr32Expand(in, out []byte) {
+	copy(out[:32], in[:32])
+	out[31] &= 0x3f
+
+	for j := 32; j < 64; j++ {
+		out[j] = in[j]<<2 | in[j-1]>>6
+	}
+	out[63] &= 0x3f
+
+	for j := 64; j < 96; j++ {
+		out[j] = in[j]<<4 | in[j-1]>>4
+	}
+	out[95] &= 0x3f
+
+	for j := 96; j < 127; j++ {
+		out[j] = in[j]<<6 | in[j-1]>>2
+	}
+	out[127] = in[126] >> 2
+}
+
+func hashNodes(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	sum := h.Sum(nil)
+	sum[31] &= 0x3f
+	return sum
+}
+
+// zeroCommitments[i] 为高度 i 的全零子树根，启动时一次性算好，并发读取无需加锁
+var zeroCommitments = func() [][]byte {
+	zc := [][]byte{make([]byte, 32)}
+	for i := 1; i < 64; i++ {
+		zc = append(zc, hashNodes(zc[i-1], zc[i-1]))
+	}
+	return zc
+}()
+
+func zeroCommitment(level int) []byte {
+	return zeroCommitments[level]
+}
+
+// pieceCIDToCommP 校验 piece CID 的编码并取出其中的 CommP
+func pieceCIDToCommP(s string) ([]byte, error) {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if c.Type() != cid.FilCommitmentUnsealed {
+		return nil, fmt.Errorf("%s is not a piece cid", s)
+	}
+	decoded, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return nil, err
+	}
+	if decoded.Code != multihash.SHA2_256_TRUNC254_PADDED || len(decoded.Digest) != 32 {
+		return nil, fmt.Errorf("%s is not a sha2-256-trunc254-padded piece cid", s)
+	}
+	return decoded.Digest, nil
+}
+
+// commPToPieceCID 把 CommP 编码为 piece CID
+func commPToPieceCID(commp []byte) (cid.Cid, error) {
+	mh, err := multihash.Encode(commp, multihash.SHA2_256_TRUNC254_PADDED)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.FilCommitmentUnsealed, mh), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func commpOf(t *testing.T, data []byte, chunk int) (string, uint64) {
+	t.Helper()
+	w := newCommpWriter()
+	for p := data; len(p) > 0; {
+		n := chunk
+		if n > len(p) {
+			n = len(p)
+		}
+		w.Write(p[:n])
+		p = p[n:]
+	}
+	sum, size, err := w.Sum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := commPToPieceCID(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.String(), size
+}
+
+// 全零 piece 的 CommP 与 lotus/go-commp-utils 中 zerocomm 表的值一致
+func TestCommpZeroPieces(t *testing.T) {
+	levels := map[int]string{
+		1: "f5a5fd42d16a20302798ef6ed309979b43003d2320d9f0e8ea9831a92759fb0b",
+		2: "3731bb99ac689f66eef5973e4a94da188f4ddcae580724fc6f3fd60dfd488333",
+		3: "642a607ef886b004bf2c1978463ae1d4693ac0f410eb2d1b7a47fe205e5e750f",
+	}
+	for level, want := range levels {
+		if got := hex.EncodeToString(zeroCommitment(level)); got != want {
+			t.Errorf("zero commitment %d = %s, want %s", level, got, want)
+		}
+	}
+
+	tests := []struct {
+		size      int
+		wantCID   string
+		wantPiece uint64
+	}{
+		// 65 字节是最小输入，和 127 字节一样填充为 128 字节的 piece
+		{65, "baga6ea4seaqdomn3tgwgrh3g532zopskstnbrd2n3sxfqbze7rxt7vqn7veigmy", 128},
+		{127, "baga6ea4seaqdomn3tgwgrh3g532zopskstnbrd2n3sxfqbze7rxt7vqn7veigmy", 128},
+		// 2KiB 扇区的全零 piece
+		{2032, "baga6ea4seaqpy7usqklokfx2vxuynmupslkeutzexe2uqurdg5vhtebhxqmpqmy", 2048},
+	}
+	for _, tt := range tests {
+		c, size := commpOf(t, make([]byte, tt.size), tt.size)
+		if c != tt.wantCID || size != tt.wantPiece {
+			t.Errorf("%d zero bytes: %s, %d, want %s, %d", tt.size, c, size, tt.wantCID, tt.wantPiece)
+		}
+	}
+}
+
+func TestCommpTooSmall(t *testing.T) {
+	w := newCommpWriter()
+	w.Write(make([]byte, 64))
+	if _, _, err := w.Sum(); err == nil {
+		t.Fatal("64 bytes accepted")
+	}
+}
+
+// refFr32 逐 bit 做 fr32 填充：每 254 bit 数据后插入 2 个 0 bit，与 fr32Expand 的移位实现相互独立
+func refFr32(data []byte) []byte {
+	bit := func(i int) byte { return data[i/8] >> (i % 8) & 1 }
+	out := make([]byte, len(data)/127*128)
+	o := 0
+	for i := 0; i < len(data)*8; i++ {
+		if o%256 == 254 {
+			o += 2
+		}
+		out[o/8] |= bit(i) << (o % 8)
+		o++
+	}
+	return out
+}
+
+// refCommp 一次性计算 CommP：补零到 127·2^n 字节，fr32 填充后逐层求 merkle 根
+func refCommp(data []byte) ([]byte, uint64) {
+	padded := uint64(128)
+	for padded/128*127 < uint64(len(data)) {
+		padded *= 2
+	}
+	buf := make([]byte, padded/128*127)
+	copy(buf, data)
+	nodes := refFr32(buf)
+	for len(nodes) > 32 {
+		next := make([]byte, 0, len(nodes)/2)
+		for i := 0; i < len(nodes); i += 64 {
+			sum := sha256.Sum256(nodes[i : i+64])
+			sum[31] &= 0x3f
+			next = append(next, sum[:]...)
+		}
+		nodes = next
+	}
+	return nodes, padded
+}
+
+func TestCommpMatchesReference(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// 包含不是 127 整数倍的长度、正好 2 的幂的 piece、以及需要多层零子树补齐的长度
+	for _, n := range []int{65, 100, 127, 128, 254, 381, 1000, 2032, 2033, 127*37 + 5, 64 << 10} {
+		data := make([]byte, n)
+		rng.Read(data)
+		want, wantSize := refCommp(data)
+		wantCID, _ := commPToPieceCID(want)
+		// 分块大小不影响结果
+		for _, chunk := range []int{1, 7, 127, 4096, n} {
+			c, size := commpOf(t, data, chunk)
+			if c != wantCID.String() || size != wantSize {
+				t.Fatalf("%d bytes in %d byte writes: %s, %d, want %s, %d", n, chunk, c, size, wantCID, wantSize)
+			}
+		}
+	}
+}
+
+func TestFr32Expand(t *testing.T) {
+	in := bytes.Repeat([]byte{0xff}, 127)
+	out := make([]byte, 128)
+	fr32Expand(in, out)
+	// 每 32 字节的最高 2 bit 为 0，其余都是 1
+	for i, b := range out {
+		want := byte(0xff)
+		if i%32 == 31 {
+			want = 0x3f
+		}
+		if b != want {
+			t.Fatalf("out[%d] = %#x, want %#x", i, b, want)
+		}
+	}
+}
+
+func TestPieceCIDRoundTrip(t *testing.T) {
+	s := "baga6ea4seaqpy7usqklokfx2vxuynmupslkeutzexe2uqurdg5vhtebhxqmpqmy"
+	commp, err := pieceCIDToCommP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := commPToPieceCID(commp)
+	if c.String() != s {
+		t.Fatalf("round trip = %s", c)
+	}
+	if _, err := pieceCIDToCommP("bafkqaaa"); err == nil {
+		t.Fatal("non-piece cid accepted")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩后的对象在 metadata 中记录压缩算法和原始大小，读取时按 metadata 自动解压
+const (
+	compressMetaCodec = "S3tools-Compression"
+	compressMetaSize  = "S3tools-Uncompressed-Size"
+)
+
+// compressRule 一条压缩规则，pattern 不含 / 时只匹配 key 的文件名
+type compressRule struct {
+	pattern string
+	codec   string
+}
+
+func parseCompressRules(s string) ([]compressRule, error) {
+	var rules []compressRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, codec, ok := strings.Cut(item, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid compress rule %q, must be pattern=codec", item)
+		}
+		if codec != "zstd" && codec != "gzip" {
+			return nil, fmt.Errorf("invalid compress codec %q, must be one of: zstd, gzip", codec)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid compress pattern %q: %w", pattern, err)
+		}
+		rules = append(rules, compressRule{pattern: pattern, codec: codec})
+	}
+	return rules, nil
+}
+
+// matchCompress 返回 key 匹配的第一条规则的压缩算法，不压缩时返回空
+func matchCompress(rules []compressRule, key string) string {
+	for _, rule := range rules {
+		name := key
+		if !strings.Contains(rule.pattern, "/") {
+			name = path.Base(key)
+		}
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return rule.codec
+		}
+	}
+	return ""
+}
+
+// compressReader 边读边压缩，压缩后的大小未知；调用方必须 Close，以便上传失败时结束压缩的 goroutine
+// 返回的 metadata 合并了 meta，记录压缩算法和原始大小（size 小于 0 时不记录）
+func compressReader(r io.Reader, codec string, size int64, meta map[string]string) (io.ReadCloser, map[string]string, error) {
+	pr, pw := io.Pipe()
+	var w io.WriteCloser
+	switch codec {
+	case "zstd":
+		enc, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		w = enc
+	case "gzip":
+		w = gzip.NewWriter(pw)
+	default:
+		return nil, nil, fmt.Errorf("unsupported compress codec: %s", codec)
+	}
+	go func() {
+		_, err := io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	metadata := make(map[string]string, len(meta)+2)
+	for key, value := range meta {
+		metadata[key] = value
+	}
+	metadata[compressMetaCodec] = codec
+	if size >= 0 {
+		metadata[compressMetaSize] = strconv.FormatInt(size, 10)
+	}
+	return pr, metadata, nil
+}
+
+// uncompressedSize 从对象 metadata 取原始大小，对象未压缩时 compressed 为 false
+func uncompressedSize(header http.Header) (size int64, compressed bool) {
+	if header.Get("X-Amz-Meta-"+compressMetaCodec) == "" {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(header.Get("X-Amz-Meta-"+compressMetaSize), 10, 64)
+	if err != nil {
+		return -1, true
+	}
+	return size, true
+}
+
+// decompressReader 按对象 metadata 解压，未压缩的对象原样返回
+func decompressReader(r io.Reader, header http.Header) (io.ReadCloser, error) {
+	switch codec := header.Get("X-Amz-Meta-" + compressMetaCodec); codec {
+	case "":
+		return io.NopCloser(r), nil
+	case "zstd":
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported compression of object: %s", codec)
+	}
+}
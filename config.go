@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// config 配置文件，包含命名的 remote 和 job
+//
+//	remotes:
+//	  myminio:
+//	    endpoint: https://minio.example.com
+//	    ak: minioadmin
+//	    sk: minioadmin
+//	    bucket_lookup: path
+//	    ca_file: /etc/ssl/myca.pem
+//	jobs:
+//	  nightly:
+//	    command: migrate
+//	    flags:
+//	      src: myminio:sealed
+//	      dst: backup:sealed/2023
+//	      concurrent: 20
+type config struct {
+	Remotes map[string]remoteConfig `yaml:"remotes"`
+	Jobs    map[string]jobConfig    `yaml:"jobs"`
+}
+
+type remoteConfig struct {
+	Endpoint     string `yaml:"endpoint"`
+	AK           string `yaml:"ak"`
+	SK           string `yaml:"sk"`
+	Region       string `yaml:"region"`
+	BucketLookup string `yaml:"bucket_lookup"`
+	// 凭证，含义同 <side>_creds 等参数
+	Creds                string `yaml:"creds"`
+	SessionToken         string `yaml:"session_token"`
+	SKFile               string `yaml:"sk_file"`
+	SKCmd                string `yaml:"sk_cmd"`
+	Profile              string `yaml:"profile"`
+	RoleARN              string `yaml:"role_arn"`
+	STSEndpoint          string `yaml:"sts_endpoint"`
+	WebIdentityTokenFile string `yaml:"web_identity_token_file"`
+	// 服务端加密，含义同 <side>_sse 等参数
+	SSE           string `yaml:"sse"`
+	SSEKMSKeyID   string `yaml:"sse_kms_key_id"`
+	SSEKMSContext string `yaml:"sse_kms_context"`
+	SSECKeyFile   string `yaml:"sse_c_key_file"`
+	// CSEKeyFile 客户端加密的主密钥文件，含义同 <side>_cse_key_file
+	CSEKeyFile string `yaml:"cse_key_file"`
+	// Insecure 跳过证书校验，CAFile 为额外信任的 CA 证书
+	Insecure bool   `yaml:"insecure"`
+	CAFile   string `yaml:"ca_file"`
+}
+
+type jobConfig struct {
+	Command string                 `yaml:"command"`
+	Flags   map[string]interface{} `yaml:"flags"`
+}
+
+var loadedConfig *config
+
+// remoteTLS 由 remote 配置的 src/dst 两端的 TLS 设置
+var remoteTLS = make(map[string]*tls.Config)
+
+// loadConfig 读取 --config 指定的配置文件，未指定时读取 ~/.s3-tools.yaml（不存在则为空配置）
+func loadConfig(cctx *cli.Context) (*config, error) {
+	if loadedConfig != nil {
+		return loadedConfig, nil
+	}
+
+	name := cctx.String("config")
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			if _, err := os.Stat(filepath.Join(home, ".s3-tools.yaml")); err == nil {
+				name = filepath.Join(home, ".s3-tools.yaml")
+			}
+		}
+	}
+
+	cfg := &config{}
+	if name != "" {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse config %s: %w", name, err)
+		}
+	}
+	loadedConfig = cfg
+	return cfg, nil
+}
+
+// lookupRemote 按配置文件、~/.mc/config.json、~/.aws/credentials 的顺序查找 remote
+func lookupRemote(cctx *cli.Context, name string) (remoteConfig, error) {
+	cfg, err := loadConfig(cctx)
+	if err != nil {
+		return remoteConfig{}, err
+	}
+	if remote, ok := cfg.Remotes[name]; ok {
+		return remote, nil
+	}
+
+	remote, ok, err := mcRemote(name)
+	if err != nil || ok {
+		return remote, err
+	}
+	remote, ok, err = awsRemote(name)
+	if err != nil || ok {
+		return remote, err
+	}
+	return remoteConfig{}, fmt.Errorf("remote %s not found in config, ~/.mc/config.json or ~/.aws/credentials", name)
+}
+
+// mcRemote 读取 mc 的 alias
+func mcRemote(name string) (remoteConfig, bool, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return remoteConfig{}, false, nil
+	}
+	data, err := os.ReadFile(filepath.Join(home, ".mc", "config.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return remoteConfig{}, false, nil
+		}
+		return remoteConfig{}, false, err
+	}
+
+	type mcAlias struct {
+		URL       string `json:"url"`
+		AccessKey string `json:"accessKey"`
+		SecretKey string `json:"secretKey"`
+		Path      string `json:"path"`
+	}
+	// 旧版本 mc 使用 hosts
+	var mc struct {
+		Aliases map[string]mcAlias `json:"aliases"`
+		Hosts   map[string]mcAlias `json:"hosts"`
+	}
+	if err := json.Unmarshal(data, &mc); err != nil {
+		return remoteConfig{}, false, fmt.Errorf("parse ~/.mc/config.json: %w", err)
+	}
+	alias, ok := mc.Aliases[name]
+	if !ok {
+		alias, ok = mc.Hosts[name]
+	}
+	if !ok {
+		return remoteConfig{}, false, nil
+	}
+
+	remote := remoteConfig{Endpoint: alias.URL, AK: alias.AccessKey, SK: alias.SecretKey}
+	switch alias.Path {
+	case "on":
+		remote.BucketLookup = "path"
+	case "off":
+		remote.BucketLookup = "dns"
+	}
+	return remote, true, nil
+}
+
+// awsRemote 读取 ~/.aws/credentials 的 profile，region 和 endpoint_url 从 ~/.aws/config 读取
+func awsRemote(name string) (remoteConfig, bool, error) {
+	home, _ := os.UserHomeDir()
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+
+	creds, err := ini.Load(credentialsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return remoteConfig{}, false, nil
+		}
+		return remoteConfig{}, false, err
+	}
+	section, err := creds.GetSection(name)
+	if err != nil {
+		return remoteConfig{}, false, nil
+	}
+	remote := remoteConfig{
+		AK:           section.Key("aws_access_key_id").String(),
+		SK:           section.Key("aws_secret_access_key").String(),
+		SessionToken: section.Key("aws_session_token").String(),
+	}
+
+	if conf, err := ini.Load(configFile); err == nil {
+		sectionName := "profile " + name
+		if name == "default" {
+			sectionName = "default"
+		}
+		if section, err := conf.GetSection(sectionName); err == nil {
+			remote.Region = section.Key("region").String()
+			remote.Endpoint = section.Key("endpoint_url").String()
+		}
+	}
+	if remote.Endpoint == "" {
+		remote.Endpoint = "https://s3.amazonaws.com"
+		if remote.Region != "" {
+			remote.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", remote.Region)
+		}
+	}
+	return remote, true, nil
+}
+
+// remoteBefore 返回命令的 Before：把 --src/--dst 指定的 remote 填入对应的参数，命令行和环境变量中已设置的参数优先
+// required 中的一端必须（从命令行、环境变量或 remote）得到 endpoint、bucket 和静态凭证的 ak、sk
+// 最后按两端的 sse、cse 参数设置 srcSSE/dstSSE 和 srcCSE/dstCSE
+func remoteBefore(required ...string) cli.BeforeFunc {
+	return func(cctx *cli.Context) error {
+		for _, side := range []string{"src", "dst"} {
+			if err := applyRemote(cctx, side); err != nil {
+				return err
+			}
+		}
+		for _, side := range required {
+			for _, field := range []string{"endpoint", "ak", "sk", "bucket"} {
+				name := side + "_" + field
+				if !hasFlag(cctx, name) || cctx.String(name) != "" {
+					continue
+				}
+				// 只有静态凭证需要 ak/sk，sk 也可以从文件或命令读取
+				static := cctx.String(side+"_creds") == "static"
+				if (field == "ak" || field == "sk") && !static {
+					continue
+				}
+				if field == "sk" && (cctx.String(side+"_sk_file") != "" || cctx.String(side+"_sk_cmd") != "") {
+					continue
+				}
+				// 迁移多个 bucket 时 bucket 来自 src_buckets
+				if field == "bucket" && hasFlag(cctx, "src_buckets") && cctx.String("src_buckets") != "" {
+					continue
+				}
+				return fmt.Errorf("Required flag %q not set, set it or use --%s remote:bucket[/prefix]", name, side)
+			}
+		}
+
+		var err error
+		if srcSSE, err = newSSE(cctx, "src"); err != nil {
+			return err
+		}
+		if dstSSE, err = newSSE(cctx, "dst"); err != nil {
+			return err
+		}
+		if srcCSE, err = newCSE(cctx, "src"); err != nil {
+			return err
+		}
+		if dstCSE, err = newCSE(cctx, "dst"); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+func applyRemote(cctx *cli.Context, side string) error {
+	if !hasFlag(cctx, side) || cctx.String(side) == "" {
+		return nil
+	}
+	spec := cctx.String(side)
+	name, location, ok := strings.Cut(spec, ":")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid %s %q, must be remote:bucket[/prefix]", side, spec)
+	}
+	remote, err := lookupRemote(cctx, name)
+	if err != nil {
+		return err
+	}
+	bucket, prefix, _ := strings.Cut(location, "/")
+
+	values := map[string]string{
+		"endpoint":                remote.Endpoint,
+		"ak":                      remote.AK,
+		"sk":                      remote.SK,
+		"region":                  remote.Region,
+		"bucket_lookup":           remote.BucketLookup,
+		"creds":                   remote.Creds,
+		"session_token":           remote.SessionToken,
+		"sk_file":                 remote.SKFile,
+		"sk_cmd":                  remote.SKCmd,
+		"profile":                 remote.Profile,
+		"role_arn":                remote.RoleARN,
+		"sts_endpoint":            remote.STSEndpoint,
+		"web_identity_token_file": remote.WebIdentityTokenFile,
+		"sse":                     remote.SSE,
+		"sse_kms_key_id":          remote.SSEKMSKeyID,
+		"sse_kms_context":         remote.SSEKMSContext,
+		"sse_c_key_file":          remote.SSECKeyFile,
+		"cse_key_file":            remote.CSEKeyFile,
+		"bucket":                  bucket,
+		"prefix":                  prefix,
+	}
+	for field, v := range values {
+		flagName := side + "_" + field
+		if v == "" || cctx.IsSet(flagName) {
+			continue
+		}
+		if !hasFlag(cctx, flagName) {
+			if field == "bucket" || field == "prefix" {
+				return fmt.Errorf("%s: this command does not take a bucket, use --%s %s:", side, side, name)
+			}
+			continue
+		}
+		if err := cctx.Set(flagName, v); err != nil {
+			return err
+		}
+	}
+
+	if remote.Insecure || remote.CAFile != "" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: remote.Insecure}
+		if remote.CAFile != "" {
+			pem, err := os.ReadFile(remote.CAFile)
+			if err != nil {
+				return err
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificate found in %s", remote.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		remoteTLS[side] = tlsConfig
+	}
+	return nil
+}
+
+func hasFlag(cctx *cli.Context, name string) bool {
+	for _, f := range cctx.Command.Flags {
+		for _, n := range f.Names() {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var run = &cli.Command{
+	Name:      "run",
+	Usage:     "run a job defined in the config file",
+	ArgsUsage: "job [flags of the job command...]",
+	UsageText: `
+the flags of the job are passed as environment variables, so flags given after the job name and
+global flags given before "run" still take precedence.
+`,
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() < 1 {
+			return fmt.Errorf("job name is required")
+		}
+		cfg, err := loadConfig(cctx)
+		if err != nil {
+			return err
+		}
+		name := cctx.Args().First()
+		job, ok := cfg.Jobs[name]
+		if !ok {
+			var names []string
+			for n := range cfg.Jobs {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("job %s not found, jobs: %s", name, strings.Join(names, ", "))
+		}
+		if job.Command == "" || job.Command == "run" {
+			return fmt.Errorf("job %s: invalid command %q", name, job.Command)
+		}
+
+		// 所有参数都绑定了同名环境变量，job 的参数通过环境变量传入
+		for k, v := range job.Flags {
+			if err := os.Setenv(k, flagValue(v)); err != nil {
+				return err
+			}
+		}
+		// 重新执行时命令行的全局参数会丢失，同样通过环境变量传入
+		for _, f := range cctx.App.Flags {
+			n := f.Names()[0]
+			if cctx.IsSet(n) {
+				if err := os.Setenv(n, fmt.Sprint(cctx.Value(n))); err != nil {
+					return err
+				}
+			}
+		}
+
+		args := append([]string{cctx.App.Name, job.Command}, cctx.Args().Tail()...)
+		return cctx.App.RunContext(cctx.Context, args)
+	},
+}
+
+// flagValue 把 yaml 中的值转换成环境变量的值，列表用逗号连接
+func flagValue(v interface{}) string {
+	if list, ok := v.([]interface{}); ok {
+		var items []string
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v)
+}
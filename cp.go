@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+var cp = &cli.Command{
+	Name:      "cp",
+	Usage:     "copy between s3, http[s] and local paths",
+	ArgsUsage: "source destination",
+	Flags:     mergeFlags(migrate.Flags, upload.Flags, download.Flags, export.Flags),
+	UsageText: `
+s3-tools cp [command options] source destination
+
+source and destination are one of:
+  s3://remote/bucket[/prefix]   remote from the config file, ~/.mc/config.json or ~/.aws/credentials
+  http[s]://host/path           source only
+  local path                    file or dir
+
+s3 to s3 runs migrate, local to s3 runs upload, http[s] to s3 or local runs download, s3 to local runs export,
+keys are mapped the same way.
+options must be given before source and destination.
+`,
+	Action: cpAction,
+}
+
+// mergeFlags 合并多个命令的参数，同名参数只保留第一个
+func mergeFlags(lists ...[]cli.Flag) []cli.Flag {
+	seen := make(map[string]bool)
+	var flags []cli.Flag
+	for _, list := range lists {
+		for _, f := range list {
+			name := f.Names()[0]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// cpLocation cp 的一个位置参数
+type cpLocation struct {
+	kind string // s3, http, local
+	// s3 为 remote:bucket/prefix，http 为 url，local 为路径
+	value string
+}
+
+func parseCpLocation(s string) (cpLocation, error) {
+	switch {
+	case strings.HasPrefix(s, "s3://"):
+		remote, location, _ := strings.Cut(strings.TrimPrefix(s, "s3://"), "/")
+		if remote == "" || location == "" {
+			return cpLocation{}, fmt.Errorf("invalid s3 url %s, must be s3://remote/bucket[/prefix]", s)
+		}
+		return cpLocation{kind: "s3", value: remote + ":" + location}, nil
+	case strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://"):
+		return cpLocation{kind: "http", value: s}, nil
+	default:
+		return cpLocation{kind: "local", value: s}, nil
+	}
+}
+
+func cpAction(cctx *cli.Context) error {
+	if cctx.NArg() != 2 {
+		return fmt.Errorf("cp requires source and destination")
+	}
+	src, err := parseCpLocation(cctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	dst, err := parseCpLocation(cctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	if dst.kind == "http" {
+		return fmt.Errorf("cannot copy to http[s] url")
+	}
+	if src.kind == "local" && dst.kind == "local" {
+		return fmt.Errorf("copying from a local path to a local path is not supported")
+	}
+
+	switch {
+	case src.kind == "s3" && dst.kind == "local":
+		if err := cctx.Set("src", src.value); err != nil {
+			return err
+		}
+		if err := cctx.Set("dir", dst.value); err != nil {
+			return err
+		}
+		if err := remoteBefore("src")(cctx); err != nil {
+			return err
+		}
+		return exportAction(cctx)
+	case src.kind == "s3":
+		if err := cctx.Set("src", src.value); err != nil {
+			return err
+		}
+		if err := cctx.Set("dst", dst.value); err != nil {
+			return err
+		}
+		if err := remoteBefore("src", "dst")(cctx); err != nil {
+			return err
+		}
+		return migrateAction(cctx)
+	case src.kind == "local":
+		if err := cctx.Set("dir", src.value); err != nil {
+			return err
+		}
+		if err := cctx.Set("dst", dst.value); err != nil {
+			return err
+		}
+		if err := remoteBefore("dst")(cctx); err != nil {
+			return err
+		}
+		return uploadAction(cctx)
+	default:
+		// download 只接受文件列表，写一个只有这个 url 的临时列表
+		list, err := os.CreateTemp("", "s3-tools-cp-*.txt")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(list.Name())
+		if _, err := fmt.Fprintln(list, src.value); err != nil {
+			list.Close()
+			return err
+		}
+		if err := list.Close(); err != nil {
+			return err
+		}
+		if err := cctx.Set("filelist", list.Name()); err != nil {
+			return err
+		}
+		if dst.kind == "local" {
+			if err := cctx.Set("dir", dst.value); err != nil {
+				return err
+			}
+			return downloadAction(cctx)
+		}
+		if err := cctx.Set("dst", dst.value); err != nil {
+			return err
+		}
+		if err := remoteBefore("dst")(cctx); err != nil {
+			return err
+		}
+		return downloadAction(cctx)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/urfave/cli/v2"
+)
+
+// credentialFlags 每一端的凭证参数，src/dst 的命令都追加这些参数
+func credentialFlags(sides ...string) []cli.Flag {
+	var flags []cli.Flag
+	for _, side := range sides {
+		flags = append(flags,
+			&cli.StringFlag{
+				Name:    side + "_creds",
+				EnvVars: []string{side + "_creds"},
+				Value:   "static",
+				Usage:   "credential provider: static, env, file, iam, assume_role, web_identity, chain",
+			},
+			&cli.StringFlag{
+				Name:    side + "_session_token",
+				EnvVars: []string{side + "_session_token"},
+				Usage:   "session token of temporary credentials, used with static",
+			},
+			&cli.StringFlag{
+				Name:    side + "_sk_file",
+				EnvVars: []string{side + "_sk_file"},
+				Usage:   "read the secret key from this file instead of " + side + "_sk",
+			},
+			&cli.StringFlag{
+				Name:    side + "_sk_cmd",
+				EnvVars: []string{side + "_sk_cmd"},
+				Usage:   "read the secret key from the output of this shell command instead of " + side + "_sk",
+			},
+			&cli.StringFlag{
+				Name:    side + "_profile",
+				EnvVars: []string{side + "_profile"},
+				Usage:   "profile of the shared credentials file, used with file",
+			},
+			&cli.StringFlag{
+				Name:    side + "_role_arn",
+				EnvVars: []string{side + "_role_arn"},
+				Usage:   "role to assume, used with assume_role and web_identity",
+			},
+			&cli.StringFlag{
+				Name:    side + "_sts_endpoint",
+				EnvVars: []string{side + "_sts_endpoint"},
+				Usage:   "sts endpoint, default " + side + "_endpoint",
+			},
+			&cli.StringFlag{
+				Name:    side + "_web_identity_token_file",
+				EnvVars: []string{side + "_web_identity_token_file"},
+				Usage:   "file of the web identity token, default $AWS_WEB_IDENTITY_TOKEN_FILE",
+			},
+		)
+	}
+	return flags
+}
+
+// secretKey 依次从 <side>_sk、<side>_sk_file、<side>_sk_cmd 读取 secret key，避免出现在命令行里
+func secretKey(cctx *cli.Context, side string) (string, error) {
+	if sk := cctx.String(side + "_sk"); sk != "" {
+		return sk, nil
+	}
+	if name := cctx.String(side + "_sk_file"); name != "" {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if command := cctx.String(side + "_sk_cmd"); command != "" {
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+				return "", fmt.Errorf("%s_sk_cmd failed: %s, %s", side, err, msg)
+			}
+			return "", fmt.Errorf("%s_sk_cmd failed: %s", side, err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return "", nil
+}
+
+// newCredentials 按 <side>_creds 创建凭证，sts 请求使用 transport（与 s3 请求的 TLS 设置一致）
+func newCredentials(cctx *cli.Context, side, endpoint string, transport http.RoundTripper) (*credentials.Credentials, error) {
+	ak := cctx.String(side + "_ak")
+	sk, err := secretKey(cctx, side)
+	if err != nil {
+		return nil, err
+	}
+	stsEndpoint := cctx.String(side + "_sts_endpoint")
+	if stsEndpoint == "" {
+		stsEndpoint = endpoint
+	}
+	client := &http.Client{Transport: transport}
+
+	switch provider := cctx.String(side + "_creds"); provider {
+	case "static", "":
+		return credentials.NewStaticV4(ak, sk, cctx.String(side+"_session_token")), nil
+	case "env":
+		return credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		}), nil
+	case "file":
+		// 文件名为空时使用 $AWS_SHARED_CREDENTIALS_FILE 或 ~/.aws/credentials
+		return credentials.NewFileAWSCredentials("", cctx.String(side+"_profile")), nil
+	case "iam":
+		// EC2 实例元数据，设置了 $AWS_CONTAINER_CREDENTIALS_RELATIVE_URI 时为 ECS 任务元数据
+		return credentials.NewIAM(""), nil
+	case "assume_role":
+		if ak == "" || sk == "" {
+			return nil, fmt.Errorf("%s_creds assume_role requires %s_ak and %s_sk", side, side, side)
+		}
+		return credentials.New(&credentials.STSAssumeRole{
+			Client:      client,
+			STSEndpoint: stsEndpoint,
+			Options: credentials.STSAssumeRoleOptions{
+				AccessKey:       ak,
+				SecretKey:       sk,
+				Location:        cctx.String(side + "_region"),
+				RoleARN:         cctx.String(side + "_role_arn"),
+				RoleSessionName: "s3-tools",
+			},
+		}), nil
+	case "web_identity":
+		tokenFile := cctx.String(side + "_web_identity_token_file")
+		if tokenFile == "" {
+			tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		if tokenFile == "" {
+			return nil, fmt.Errorf("%s_creds web_identity requires %s_web_identity_token_file", side, side)
+		}
+		roleARN := cctx.String(side + "_role_arn")
+		if roleARN == "" {
+			roleARN = os.Getenv("AWS_ROLE_ARN")
+		}
+		return credentials.New(&credentials.STSWebIdentity{
+			Client:      client,
+			STSEndpoint: stsEndpoint,
+			RoleARN:     roleARN,
+			// token 文件可能被轮换，每次刷新凭证时重新读取
+			GetWebIDTokenExpiry: func() (*credentials.WebIdentityToken, error) {
+				token, err := os.ReadFile(tokenFile)
+				if err != nil {
+					return nil, err
+				}
+				return &credentials.WebIdentityToken{Token: strings.TrimSpace(string(token))}, nil
+			},
+		}), nil
+	case "chain":
+		// 与 aws/mc 的查找顺序一致：环境变量、共享凭证文件、mc 配置、实例元数据
+		return credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{Profile: cctx.String(side + "_profile")},
+			&credentials.FileMinioClient{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		}), nil
+	default:
+		return nil, fmt.Errorf("invalid %s_creds value: %s, must be one of: static, env, file, iam, assume_role, web_identity, chain", side, provider)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+)
+
+// 客户端加密：每个对象随机生成数据密钥，用 AES-256-GCM 按 cseChunkSize 分块加密，
+// 数据密钥用主密钥（同样是 AES-256-GCM）加密后和算法、主密钥 id 一起保存在对象的 metadata 中。
+// 每块的 nonce 为块序号，最后一块带结束标记，截断、重排、篡改都会导致解密失败
+const (
+	cseAlgorithm = "AES-256-GCM-64K"
+	cseChunkSize = 64 << 10
+	cseTagSize   = 16
+
+	cseMetaAlgorithm = "S3tools-Cse-Alg"
+	cseMetaKey       = "S3tools-Cse-Key"
+	cseMetaKeyID     = "S3tools-Cse-Key-Id"
+	cseMetaSize      = "S3tools-Cse-Size"
+)
+
+// src/dst 两端的客户端加密主密钥，由 remoteBefore 根据 <side>_cse_key_file 设置，nil 表示不加密
+// 写入 dst 时加密，读取 src 时解密
+var srcCSE, dstCSE *cseKey
+
+type cseKey struct {
+	aead cipher.AEAD
+	// id 主密钥的指纹，用于识别对象是否由同一个主密钥加密
+	id string
+}
+
+// cseFlags 每一端的客户端加密参数
+func cseFlags(sides ...string) []cli.Flag {
+	var flags []cli.Flag
+	for _, side := range sides {
+		flags = append(flags,
+			&cli.StringFlag{
+				Name:    side + "_cse_key_file",
+				EnvVars: []string{side + "_cse_key_file"},
+				Usage:   "client side encryption master key file, 32 bytes raw, hex or base64",
+			},
+		)
+	}
+	return flags
+}
+
+// newCSE 按 <side>_cse_key_file 读取主密钥，命令没有这个参数或未设置时返回 nil
+func newCSE(cctx *cli.Context, side string) (*cseKey, error) {
+	if !hasFlag(cctx, side+"_cse_key_file") || cctx.String(side+"_cse_key_file") == "" {
+		return nil, nil
+	}
+	key, err := readKeyFile(cctx.String(side + "_cse_key_file"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &cseKey{aead: aead, id: hex.EncodeToString(sum[:8])}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cseStoredSize 明文大小对应的密文大小，k 为 nil 或大小未知时原样返回
+func cseStoredSize(k *cseKey, size int64) int64 {
+	if k == nil || size < 0 {
+		return size
+	}
+	chunks := (size + cseChunkSize - 1) / cseChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return size + chunks*cseTagSize
+}
+
+// csePlainSize 密文大小对应的明文大小，k 为 nil 时原样返回
+func csePlainSize(k *cseKey, size int64) int64 {
+	if k == nil || size < 0 {
+		return size
+	}
+	chunks := (size + cseChunkSize + cseTagSize - 1) / (cseChunkSize + cseTagSize)
+	return size - chunks*cseTagSize
+}
+
+// encrypt 返回加密后的数据流、密文大小，以及需要保存到对象上的 metadata（合并了 meta）
+func (k *cseKey) encrypt(r io.Reader, size int64, meta map[string]string) (io.Reader, int64, map[string]string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, 0, nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, 0, nil, err
+	}
+	wrapped := k.aead.Seal(nonce, nonce, dataKey, []byte(cseAlgorithm))
+
+	metadata := make(map[string]string, len(meta)+4)
+	for key, value := range meta {
+		metadata[key] = value
+	}
+	metadata[cseMetaAlgorithm] = cseAlgorithm
+	metadata[cseMetaKey] = base64.StdEncoding.EncodeToString(wrapped)
+	metadata[cseMetaKeyID] = k.id
+	if size >= 0 {
+		metadata[cseMetaSize] = strconv.FormatInt(size, 10)
+	}
+
+	reader := &cseReader{
+		aead:  aead,
+		src:   bufio.NewReader(r),
+		chunk: make([]byte, cseChunkSize),
+		seal:  true,
+	}
+	return reader, cseStoredSize(k, size), metadata, nil
+}
+
+// decrypt 按对象 metadata 中的数据密钥解密，header 为 GetObject/StatObject 返回的对象 metadata
+func (k *cseKey) decrypt(r io.Reader, header http.Header) (io.Reader, error) {
+	get := func(name string) string { return header.Get("X-Amz-Meta-" + name) }
+	if alg := get(cseMetaAlgorithm); alg != cseAlgorithm {
+		if alg == "" {
+			return nil, fmt.Errorf("object is not client side encrypted")
+		}
+		return nil, fmt.Errorf("unsupported client side encryption algorithm: %s", alg)
+	}
+	if id := get(cseMetaKeyID); id != k.id {
+		return nil, fmt.Errorf("object is encrypted with another master key: %s", id)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(get(cseMetaKey))
+	if err != nil || len(wrapped) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid client side encryption key in metadata")
+	}
+	nonceSize := k.aead.NonceSize()
+	dataKey, err := k.aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], []byte(cseAlgorithm))
+	if err != nil {
+		return nil, fmt.Errorf("unwrap client side encryption key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &cseReader{
+		aead:  aead,
+		src:   bufio.NewReader(r),
+		chunk: make([]byte, cseChunkSize+cseTagSize),
+	}, nil
+}
+
+// errCSECorrupted 密文被截断或篡改
+var errCSECorrupted = errors.New("client side decryption failed: object corrupted or truncated")
+
+// cseReader 分块加密（seal）或解密，读满一块后再看一个字节判断是否为最后一块
+type cseReader struct {
+	aead    cipher.AEAD
+	src     *bufio.Reader
+	chunk   []byte
+	out     []byte
+	seal    bool
+	counter uint64
+	buf     []byte
+	done    bool
+}
+
+func (r *cseReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *cseReader) next() error {
+	n, err := io.ReadFull(r.src, r.chunk)
+	final := false
+	switch err {
+	case nil:
+		if _, perr := r.src.Peek(1); perr == io.EOF {
+			final = true
+		} else if perr != nil {
+			return perr
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+
+	nonce := make([]byte, r.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, r.counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	r.counter++
+	r.done = final
+
+	if r.seal {
+		r.out = r.aead.Seal(r.out[:0], nonce, r.chunk[:n], nil)
+		r.buf = r.out
+		return nil
+	}
+	r.buf, err = r.aead.Open(r.chunk[:0], nonce, r.chunk[:n], nil)
+	if err != nil {
+		return errCSECorrupted
+	}
+	return nil
+}
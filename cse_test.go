@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func testCSEKey(t *testing.T) *cseKey {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(key)
+	return &cseKey{aead: aead, id: hex.EncodeToString(sum[:8])}
+}
+
+// cseEncrypt 加密 plain，返回密文和对象 metadata 对应的响应头
+func cseEncrypt(t *testing.T, k *cseKey, plain []byte) ([]byte, http.Header) {
+	t.Helper()
+	r, size, meta, err := k.encrypt(bytes.NewReader(plain), int64(len(plain)), map[string]string{"Owner": "ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(cipherText)) != size {
+		t.Fatalf("ciphertext size %d, encrypt returned %d", len(cipherText), size)
+	}
+	header := make(http.Header)
+	for key, value := range meta {
+		header.Set("X-Amz-Meta-"+key, value)
+	}
+	return cipherText, header
+}
+
+func cseDecrypt(k *cseKey, cipherText []byte, header http.Header) ([]byte, error) {
+	r, err := k.decrypt(bytes.NewReader(cipherText), header)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestCSERoundTrip(t *testing.T) {
+	k := testCSEKey(t)
+	sizes := []int{0, 1, cseChunkSize - 1, cseChunkSize, cseChunkSize + 1, 2*cseChunkSize - 1, 2 * cseChunkSize, 2*cseChunkSize + 1, 3*cseChunkSize + 12345}
+	for _, size := range sizes {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		cipherText, header := cseEncrypt(t, k, plain)
+
+		if got := cseStoredSize(k, int64(size)); got != int64(len(cipherText)) {
+			t.Errorf("size %d: cseStoredSize = %d, ciphertext %d", size, got, len(cipherText))
+		}
+		if got := csePlainSize(k, int64(len(cipherText))); got != int64(size) {
+			t.Errorf("size %d: csePlainSize = %d", size, got)
+		}
+		if header.Get("X-Amz-Meta-"+cseMetaSize) == "" || header.Get("X-Amz-Meta-Owner") != "ops" {
+			t.Errorf("size %d: unexpected metadata %v", size, header)
+		}
+
+		got, err := cseDecrypt(k, cipherText, header)
+		if err != nil {
+			t.Fatalf("size %d: decrypt: %s", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestCSETruncated(t *testing.T) {
+	k := testCSEKey(t)
+	for _, size := range []int{0, 100, cseChunkSize, 2 * cseChunkSize, 2*cseChunkSize + 100} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		cipherText, header := cseEncrypt(t, k, plain)
+
+		cuts := []int{1, cseTagSize}
+		// 去掉完整的最后一块，前一块不是最后一块，也必须报错
+		if size > cseChunkSize {
+			last := len(cipherText) - (size/cseChunkSize)*(cseChunkSize+cseTagSize)
+			if last == 0 {
+				last = cseChunkSize + cseTagSize
+			}
+			cuts = append(cuts, last)
+		}
+		for _, cut := range cuts {
+			if cut > len(cipherText) {
+				continue
+			}
+			_, err := cseDecrypt(k, cipherText[:len(cipherText)-cut], header)
+			if !errors.Is(err, errCSECorrupted) {
+				t.Errorf("size %d cut %d: err = %v, want errCSECorrupted", size, cut, err)
+			}
+		}
+	}
+}
+
+func TestCSETampered(t *testing.T) {
+	k := testCSEKey(t)
+	plain := make([]byte, 2*cseChunkSize+10)
+	rand.Read(plain)
+	cipherText, header := cseEncrypt(t, k, plain)
+
+	for _, pos := range []int{0, cseChunkSize + cseTagSize + 5, len(cipherText) - 1} {
+		tampered := append([]byte(nil), cipherText...)
+		tampered[pos] ^= 0x01
+		if _, err := cseDecrypt(k, tampered, header); !errors.Is(err, errCSECorrupted) {
+			t.Errorf("byte %d flipped: err = %v, want errCSECorrupted", pos, err)
+		}
+	}
+
+	// 交换两块的顺序
+	block := cseChunkSize + cseTagSize
+	swapped := append(append(append([]byte(nil), cipherText[block:2*block]...), cipherText[:block]...), cipherText[2*block:]...)
+	if _, err := cseDecrypt(k, swapped, header); !errors.Is(err, errCSECorrupted) {
+		t.Errorf("chunks swapped: err = %v, want errCSECorrupted", err)
+	}
+}
+
+func TestCSEWrongKey(t *testing.T) {
+	k := testCSEKey(t)
+	cipherText, header := cseEncrypt(t, k, []byte("sector data"))
+
+	other := testCSEKey(t)
+	if _, err := cseDecrypt(other, cipherText, header); err == nil {
+		t.Fatal("decrypt with another master key succeeded")
+	}
+	// 指纹相同但主密钥不同时解包数据密钥失败
+	other.id = k.id
+	if _, err := cseDecrypt(other, cipherText, header); err == nil {
+		t.Fatal("decrypt with another master key and the same id succeeded")
+	}
+
+	if _, err := cseDecrypt(k, cipherText, make(http.Header)); err == nil {
+		t.Fatal("decrypt without metadata succeeded")
+	}
+}
+
+func TestCSESizeUnknown(t *testing.T) {
+	if got := cseStoredSize(nil, 100); got != 100 {
+		t.Errorf("cseStoredSize(nil) = %d", got)
+	}
+	k := testCSEKey(t)
+	if got := cseStoredSize(k, -1); got != -1 {
+		t.Errorf("cseStoredSize(-1) = %d", got)
+	}
+	if got := csePlainSize(k, -1); got != -1 {
+		t.Errorf("csePlainSize(-1) = %d", got)
+	}
+}
+
+func TestPlainSize(t *testing.T) {
+	k := testCSEKey(t)
+	stored := cseStoredSize(k, 100000)
+	tests := []struct {
+		name string
+		info minio.ObjectInfo
+		k    *cseKey
+		want int64
+	}{
+		{"plain", minio.ObjectInfo{Size: 100}, nil, 100},
+		// 列举结果没有 metadata，按密钥推算
+		{"encrypted listing", minio.ObjectInfo{Size: stored}, k, 100000},
+		{"encrypted", minio.ObjectInfo{Size: stored, Metadata: http.Header{"X-Amz-Meta-S3tools-Cse-Size": {"100000"}}}, nil, 100000},
+		{"compressed", minio.ObjectInfo{Size: 10, Metadata: http.Header{
+			"X-Amz-Meta-S3tools-Compression":       {"zstd"},
+			"X-Amz-Meta-S3tools-Uncompressed-Size": {"100000"},
+		}}, nil, 100000},
+		// 先压缩再加密，加密前的大小未知，以压缩前的大小为准
+		{"compressed and encrypted", minio.ObjectInfo{Size: cseStoredSize(k, 10), Metadata: http.Header{
+			"X-Amz-Meta-S3tools-Compression":       {"gzip"},
+			"X-Amz-Meta-S3tools-Uncompressed-Size": {"100000"},
+		}}, k, 100000},
+		{"compressed size unknown", minio.ObjectInfo{Size: 10, Metadata: http.Header{"X-Amz-Meta-S3tools-Compression": {"zstd"}}}, nil, -1},
+	}
+	for _, tt := range tests {
+		if got := plainSize(tt.info, tt.k); got != tt.want {
+			t.Errorf("%s: plainSize = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// jobDedup watch 模式下记录已经派发过的对象，maxAge 之内不会重复派发
+type jobDedup interface {
+	seen(key string) (bool, error)
+	add(key string) error
+	// expire 在每一轮列举结束后调用，删除超过 maxAge 的记录
+	expire() error
+}
+
+// memDedup 内存中的记录，对象很多时占用大量内存
+type memDedup struct {
+	jobs   map[string]time.Time
+	maxAge time.Duration
+}
+
+func newMemDedup(maxAge time.Duration) *memDedup {
+	return &memDedup{jobs: make(map[string]time.Time), maxAge: maxAge}
+}
+
+func (d *memDedup) seen(key string) (bool, error) {
+	_, ok := d.jobs[key]
+	return ok, nil
+}
+
+func (d *memDedup) add(key string) error {
+	d.jobs[key] = time.Now()
+	return nil
+}
+
+func (d *memDedup) expire() error {
+	deleteOldEntries(d.jobs, int(d.maxAge/time.Hour))
+	return nil
+}
+
+// diskDedup 磁盘上的记录，内存占用有上限，重启后继续使用：
+// 每条记录为 key 的 64 位 FNV-1a 哈希和派发时间，按哈希排序存放在 dir/dedup.db，内存中只保留每 dedupBlock 条记录的第一个哈希作为索引，
+// 查询时读一个块。新记录先放在内存中，超过 dedupRunSize 条时排序写入 dir/run-*.db，每轮结束后与 dedup.db 合并并删除过期记录，
+// 启动时合并上次中断留下的 run 文件。不同 key 的哈希相同时（千万级对象约十万分之一的概率）后一个对象会被当作已派发，最多推迟 maxAge
+type diskDedup struct {
+	dir    string
+	maxAge time.Duration
+
+	base  *os.File
+	count int64
+	index []uint64
+
+	pending []dedupEntry
+	runs    []string
+}
+
+const (
+	dedupEntrySize = 12
+	dedupBlock     = 256
+	dedupRunSize   = 1 << 20
+)
+
+type dedupEntry struct {
+	hash uint64
+	time uint32
+}
+
+func dedupHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func openDiskDedup(dir string, maxAge time.Duration) (*diskDedup, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	runs, err := filepath.Glob(filepath.Join(dir, "run-*.db"))
+	if err != nil {
+		return nil, err
+	}
+	d := &diskDedup{dir: dir, maxAge: maxAge, runs: runs}
+	// 合并上次中断时留下的 run 文件，同时建立索引
+	if err := d.expire(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *diskDedup) seen(key string) (bool, error) {
+	if d.count == 0 {
+		return false, nil
+	}
+	hash := dedupHash(key)
+	// 最后一个第一个哈希不大于 hash 的块
+	block := sort.Search(len(d.index), func(i int) bool { return d.index[i] > hash }) - 1
+	if block < 0 {
+		return false, nil
+	}
+	n := d.count - int64(block)*dedupBlock
+	if n > dedupBlock {
+		n = dedupBlock
+	}
+	buf := make([]byte, n*dedupEntrySize)
+	if _, err := d.base.ReadAt(buf, int64(block)*dedupBlock*dedupEntrySize); err != nil {
+		return false, err
+	}
+	i := sort.Search(int(n), func(i int) bool {
+		return binary.BigEndian.Uint64(buf[i*dedupEntrySize:]) >= hash
+	})
+	return i < int(n) && binary.BigEndian.Uint64(buf[i*dedupEntrySize:]) == hash, nil
+}
+
+func (d *diskDedup) add(key string) error {
+	d.pending = append(d.pending, dedupEntry{hash: dedupHash(key), time: uint32(time.Now().Unix())})
+	if len(d.pending) >= dedupRunSize {
+		return d.spill()
+	}
+	return nil
+}
+
+// spill 把内存中的新记录排序后写入一个 run 文件
+func (d *diskDedup) spill() error {
+	sort.Slice(d.pending, func(i, j int) bool { return d.pending[i].hash < d.pending[j].hash })
+	name := filepath.Join(d.dir, fmt.Sprintf("run-%d.db", time.Now().UnixNano()))
+	err := writeDedupFile(name, func(w *bufio.Writer) error {
+		for _, e := range d.pending {
+			if err := writeDedupEntry(w, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.runs = append(d.runs, name)
+	d.pending = d.pending[:0]
+	return nil
+}
+
+// expire 把 run 文件和内存中的新记录合并到 dedup.db，哈希相同时保留最新的时间，删除过期的记录
+func (d *diskDedup) expire() error {
+	if len(d.pending) > 0 {
+		if err := d.spill(); err != nil {
+			return err
+		}
+	}
+	name := filepath.Join(d.dir, "dedup.db")
+	sources := append([]string{name}, d.runs...)
+	var readers dedupHeap
+	for _, source := range sources {
+		f, err := os.Open(source)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r := &dedupReader{r: bufio.NewReader(f)}
+		if ok, err := r.next(); err != nil {
+			return fmt.Errorf("read %s: %w", source, err)
+		} else if ok {
+			readers = append(readers, r)
+		}
+	}
+	heap.Init(&readers)
+
+	deadline := uint32(time.Now().Add(-d.maxAge).Unix())
+	var count int64
+	var index []uint64
+	err := writeDedupFile(name, func(w *bufio.Writer) error {
+		for readers.Len() > 0 {
+			e := readers[0].cur
+			// 合并所有相同哈希的记录
+			for readers.Len() > 0 && readers[0].cur.hash == e.hash {
+				if readers[0].cur.time > e.time {
+					e.time = readers[0].cur.time
+				}
+				ok, err := readers[0].next()
+				if err != nil {
+					return err
+				}
+				if ok {
+					heap.Fix(&readers, 0)
+				} else {
+					heap.Pop(&readers)
+				}
+			}
+			if e.time < deadline {
+				continue
+			}
+			if count%dedupBlock == 0 {
+				index = append(index, e.hash)
+			}
+			count++
+			if err := writeDedupEntry(w, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, run := range d.runs {
+		os.Remove(run)
+	}
+	d.runs = nil
+
+	if d.base != nil {
+		d.base.Close()
+	}
+	d.base, err = os.Open(name)
+	if err != nil {
+		return err
+	}
+	d.count, d.index = count, index
+	return nil
+}
+
+// writeDedupFile 先写临时文件再改名，中断时不会留下不完整的文件
+func writeDedupFile(name string, fn func(w *bufio.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+strings.TrimSuffix(filepath.Base(name), ".db")+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	err = fn(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func writeDedupEntry(w io.Writer, e dedupEntry) error {
+	var buf [dedupEntrySize]byte
+	binary.BigEndian.PutUint64(buf[:8], e.hash)
+	binary.BigEndian.PutUint32(buf[8:], e.time)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+type dedupReader struct {
+	r   *bufio.Reader
+	cur dedupEntry
+}
+
+func (r *dedupReader) next() (bool, error) {
+	var buf [dedupEntrySize]byte
+	if _, err := io.ReadFull(r.r, buf[:]); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	r.cur = dedupEntry{hash: binary.BigEndian.Uint64(buf[:8]), time: binary.BigEndian.Uint32(buf[8:])}
+	return true, nil
+}
+
+// dedupHeap 按当前记录的哈希排序的多路归并堆
+type dedupHeap []*dedupReader
+
+func (h dedupHeap) Len() int            { return len(h) }
+func (h dedupHeap) Less(i, j int) bool  { return h[i].cur.hash < h[j].cur.hash }
+func (h dedupHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *dedupHeap) Push(x interface{}) { *h = append(*h, x.(*dedupReader)) }
+func (h *dedupHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskDedupSeen(t *testing.T) {
+	d, err := openDiskDedup(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 跨越多个索引块
+	n := 3*dedupBlock + 17
+	for i := 0; i < n; i++ {
+		if err := d.add(fmt.Sprintf("bucket/key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 本轮新加的记录合并后才能查到
+	if seen, _ := d.seen("bucket/key-0"); seen {
+		t.Fatal("key seen before expire")
+	}
+	if err := d.expire(); err != nil {
+		t.Fatal(err)
+	}
+	if d.count != int64(n) || len(d.index) != 4 {
+		t.Fatalf("count = %d, index = %d", d.count, len(d.index))
+	}
+	for i := 0; i < n; i++ {
+		if seen, err := d.seen(fmt.Sprintf("bucket/key-%d", i)); err != nil || !seen {
+			t.Fatalf("key-%d: seen = %t, err = %v", i, seen, err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if seen, _ := d.seen(fmt.Sprintf("bucket/other-%d", i)); seen {
+			t.Fatalf("other-%d seen", i)
+		}
+	}
+}
+
+func TestDiskDedupRestart(t *testing.T) {
+	dir := t.TempDir()
+	d, err := openDiskDedup(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.add("bucket/merged")
+	if err := d.expire(); err != nil {
+		t.Fatal(err)
+	}
+	// 中断前已经写出 run 文件，还没有合并
+	d.add("bucket/spilled")
+	if err := d.spill(); err != nil {
+		t.Fatal(err)
+	}
+	d.base.Close()
+
+	d, err = openDiskDedup(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"bucket/merged", "bucket/spilled"} {
+		if seen, _ := d.seen(key); !seen {
+			t.Fatalf("%s not seen after restart", key)
+		}
+	}
+	if runs, _ := filepath.Glob(filepath.Join(dir, "run-*.db")); len(runs) != 0 {
+		t.Fatalf("run files left after restart: %v", runs)
+	}
+}
+
+func TestDiskDedupExpire(t *testing.T) {
+	d, err := openDiskDedup(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := uint32(time.Now().Add(-2 * time.Hour).Unix())
+	d.pending = append(d.pending, dedupEntry{hash: dedupHash("bucket/old"), time: old})
+	d.add("bucket/new")
+	if err := d.expire(); err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := d.seen("bucket/old"); seen {
+		t.Fatal("expired key still seen")
+	}
+	if seen, _ := d.seen("bucket/new"); !seen || d.count != 1 {
+		t.Fatalf("new key: seen = %t, count = %d", seen, d.count)
+	}
+}
+
+func TestDiskDedupDuplicateKeepsNewest(t *testing.T) {
+	dir := t.TempDir()
+	d, err := openDiskDedup(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := dedupHash("bucket/dup")
+	old := uint32(time.Now().Add(-2 * time.Hour).Unix())
+	now := uint32(time.Now().Unix())
+	// 同一个哈希分别出现在 dedup.db、两个 run 文件中
+	d.pending = append(d.pending, dedupEntry{hash: hash, time: old})
+	if err := d.spill(); err != nil {
+		t.Fatal(err)
+	}
+	d.pending = append(d.pending, dedupEntry{hash: hash, time: now})
+	if err := d.spill(); err != nil {
+		t.Fatal(err)
+	}
+	d.pending = append(d.pending, dedupEntry{hash: hash, time: old})
+	if err := d.expire(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "dedup.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := &dedupReader{r: bufio.NewReader(f)}
+	var entries []dedupEntry
+	for {
+		ok, err := r.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		entries = append(entries, r.cur)
+	}
+	if len(entries) != 1 || entries[0] != (dedupEntry{hash: hash, time: now}) {
+		t.Fatalf("entries = %+v, want one entry with the newest time", entries)
+	}
+}
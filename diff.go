@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/urfave/cli/v2"
+)
+
+var diff = &cli.Command{
+	Name:  "diff",
+	Usage: "compare src bucket or local dir with dst bucket",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:    "dir",
+			EnvVars: []string{"dir"},
+			Usage:   "compare this local dir (same layout as upload) instead of the src bucket",
+		},
+		&cli.BoolFlag{
+			Name:    "checksum",
+			EnvVars: []string{"checksum"},
+			Usage:   "with --dir, compute local md5 and compare it with the dst ETag (single part uploads only)",
+		},
+		&cli.StringFlag{
+			Name:    "format",
+			EnvVars: []string{"format"},
+			Value:   "text",
+			Usage:   "report format: text, json (one object per line)",
+		},
+	}, append(append(append(endpointFlags("src", "dst"), bucketFlags("src", "dst")...), credentialFlags("src", "dst")...), sseFlags("src", "dst")...)...),
+	UsageText: `
+compare src_bucket/src_prefix (or --dir) with dst_bucket/dst_prefix using the same key mapping as migrate (or upload).
+exit code is 0 when both sides are identical, 1 when differences were found.
+ETags are only compared when neither side is a multipart upload or encrypted with SSE-KMS/SSE-C (--src_sse/--dst_sse).
+compressed or client side encrypted objects are compared by the original size recorded in their metadata, objects without it are reported as unverifiable.
+`,
+	// 与 diff(1) 一致：有差异时退出码为 1，出错时为 2
+	Before: func(cctx *cli.Context) error {
+		errorExitCode = 2
+		return remoteBefore("dst")(cctx)
+	},
+	OnUsageError: func(cctx *cli.Context, err error, isSubcommand bool) error {
+		errorExitCode = 2
+		return err
+	},
+	Action: diffAction,
+}
+
+// diffItem 参与比较的一个对象，key 为去掉目标前缀后的相对 key
+type diffItem struct {
+	key  string
+	size int64
+	etag string
+	path string // 本地文件路径，仅 --dir 时有
+	// stat 取对象的 metadata，仅 s3 的对象有
+	stat func() (minio.ObjectInfo, error)
+	err  error
+}
+
+// diffResult 一条差异
+type diffResult struct {
+	Type    string `json:"type"`
+	Key     string `json:"key"`
+	SrcSize int64  `json:"src_size,omitempty"`
+	DstSize int64  `json:"dst_size,omitempty"`
+	SrcETag string `json:"src_etag,omitempty"`
+	DstETag string `json:"dst_etag,omitempty"`
+}
+
+func diffAction(cctx *cli.Context) error {
+	dst_bucket := cctx.String("dst_bucket")
+	dst_prefix := cctx.String("dst_prefix")
+	src_prefix := cctx.String("src_prefix")
+	if cctx.IsSet("dir") == cctx.IsSet("src_bucket") {
+		return fmt.Errorf("must specify one of dir or src_bucket")
+	}
+	format := cctx.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid format value: %s, must be one of: text, json", format)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dst_endpoint, dstOptions, err := newS3Options(cctx, "dst")
+	if err != nil {
+		return err
+	}
+	dst, err := minio.New(dst_endpoint, dstOptions)
+	if err != nil {
+		return err
+	}
+
+	// migrate 和 upload 都把 key 拼在 dst_prefix 之后，这里按同样的规则还原出相对 key
+	dstBase := ""
+	if p := path.Join(dst_prefix); p != "" && p != "." {
+		dstBase = p + "/"
+	}
+
+	var srcCh <-chan diffItem
+	var listPrefix string
+	srcETagMD5 := true
+	if cctx.IsSet("dir") {
+		dir := cctx.String("dir")
+		files, err := listFiles(dir)
+		if err != nil {
+			return err
+		}
+		srcCh, err = localDiffItems(files)
+		if err != nil {
+			return err
+		}
+		if d := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(dir)), "/"); d != "." {
+			listPrefix = d + "/"
+		}
+	} else {
+		src_endpoint, srcOptions, err := newS3Options(cctx, "src")
+		if err != nil {
+			return err
+		}
+		src, err := minio.New(src_endpoint, srcOptions)
+		if err != nil {
+			return err
+		}
+		srcCh = s3DiffItems(ctx, src, cctx.String("src_bucket"), src_prefix, "", srcSSE)
+		listPrefix = src_prefix
+		srcETagMD5 = etagIsMD5(srcSSE, src_endpoint)
+	}
+	dstCh := s3DiffItems(ctx, dst, dst_bucket, dstBase+listPrefix, dstBase, dstSSE)
+	// 加密对象的 ETag 通常不是 md5，两端加密方式不同时 ETag 也不可比
+	compareETag := etagIsMD5(dstSSE, dst_endpoint) && srcETagMD5
+
+	report := func(r diffResult) {
+		if format == "json" {
+			line, _ := json.Marshal(r)
+			fmt.Println(string(line))
+			return
+		}
+		switch r.Type {
+		case "missing":
+			fmt.Printf("missing  %s\n", r.Key)
+		case "extra":
+			fmt.Printf("extra    %s\n", r.Key)
+		case "size":
+			fmt.Printf("size     %s src=%d dst=%d\n", r.Key, r.SrcSize, r.DstSize)
+		case "etag":
+			fmt.Printf("etag     %s src=%s dst=%s\n", r.Key, r.SrcETag, r.DstETag)
+		case "unverifiable":
+			fmt.Printf("unverifiable %s\n", r.Key)
+		}
+	}
+
+	counts := make(map[string]int)
+	var same int
+	src, srcOk := <-srcCh
+	dstItem, dstOk := <-dstCh
+	for srcOk || dstOk {
+		if srcOk && src.err != nil {
+			return fmt.Errorf("ListObjects error: %w", src.err)
+		}
+		if dstOk && dstItem.err != nil {
+			return fmt.Errorf("ListObjects error: %w", dstItem.err)
+		}
+
+		var r *diffResult
+		switch {
+		case !dstOk || (srcOk && src.key < dstItem.key):
+			r = &diffResult{Type: "missing", Key: src.key, SrcSize: src.size}
+			src, srcOk = <-srcCh
+		case !srcOk || dstItem.key < src.key:
+			r = &diffResult{Type: "extra", Key: dstItem.key, DstSize: dstItem.size}
+			dstItem, dstOk = <-dstCh
+		default:
+			r, err = compareDiffItems(src, dstItem, cctx.Bool("checksum"), compareETag)
+			if err != nil {
+				return err
+			}
+			src, srcOk = <-srcCh
+			dstItem, dstOk = <-dstCh
+		}
+		if r == nil {
+			same++
+			continue
+		}
+		counts[r.Type]++
+		report(*r)
+	}
+
+	total := counts["missing"] + counts["extra"] + counts["size"] + counts["etag"] + counts["unverifiable"]
+	fmt.Fprintf(os.Stderr, "identical: %d, missing: %d, extra: %d, size mismatch: %d, etag mismatch: %d, unverifiable: %d\n",
+		same, counts["missing"], counts["extra"], counts["size"], counts["etag"], counts["unverifiable"])
+	if total > 0 {
+		return cli.Exit(fmt.Sprintf("%d differences found", total), 1)
+	}
+	return nil
+}
+
+// compareDiffItems 比较 key 相同的两个对象，一致时返回 nil，compareETag 为 false 时只比较大小
+func compareDiffItems(src, dst diffItem, checksum, compareETag bool) (*diffResult, error) {
+	if src.size != dst.size {
+		r, encoded, err := comparePlainSize(src, dst)
+		if err != nil || encoded {
+			return r, err
+		}
+		return &diffResult{Type: "size", Key: src.key, SrcSize: src.size, DstSize: dst.size}, nil
+	}
+	if !compareETag {
+		return nil, nil
+	}
+	// 分片上传的 ETag 与分片大小有关，无法比较
+	if strings.Contains(dst.etag, "-") {
+		return nil, nil
+	}
+	srcETag := src.etag
+	if src.path != "" {
+		if !checksum {
+			return nil, nil
+		}
+		sum, err := fileMD5(src.path)
+		if err != nil {
+			return nil, err
+		}
+		srcETag = sum
+	}
+	if strings.Contains(srcETag, "-") {
+		return nil, nil
+	}
+	if srcETag != dst.etag {
+		r, encoded, err := comparePlainSize(src, dst)
+		if err != nil || encoded {
+			return r, err
+		}
+		return &diffResult{Type: "etag", Key: src.key, SrcETag: srcETag, DstETag: dst.etag}, nil
+	}
+	return nil, nil
+}
+
+// comparePlainSize 列举结果不一致时取两端的 metadata：压缩、客户端加密过的对象存储的大小和 ETag 都不是原始内容的，
+// 只能比较 metadata 中记录的原始大小；原始大小未知时报告为 unverifiable。两端都没有编码时 encoded 为 false，由调用方按列举结果比较
+func comparePlainSize(src, dst diffItem) (r *diffResult, encoded bool, err error) {
+	srcSize, srcEncoded, err := src.plainSize()
+	if err != nil {
+		return nil, false, err
+	}
+	dstSize, dstEncoded, err := dst.plainSize()
+	if err != nil {
+		return nil, false, err
+	}
+	if !srcEncoded && !dstEncoded {
+		return nil, false, nil
+	}
+	if srcSize < 0 || dstSize < 0 {
+		return &diffResult{Type: "unverifiable", Key: src.key}, true, nil
+	}
+	if srcSize != dstSize {
+		return &diffResult{Type: "size", Key: src.key, SrcSize: srcSize, DstSize: dstSize}, true, nil
+	}
+	return nil, true, nil
+}
+
+// plainSize 对象原始内容的大小，-1 表示未知；encoded 表示对象压缩或客户端加密过。本地文件原样返回
+func (d diffItem) plainSize() (size int64, encoded bool, err error) {
+	if d.stat == nil {
+		return d.size, false, nil
+	}
+	info, err := d.stat()
+	if err != nil {
+		return 0, false, fmt.Errorf("StatObject error: %w", err)
+	}
+	// 密文大小的换算只与加密算法有关，不需要主密钥
+	var k *cseKey
+	if info.Metadata.Get("X-Amz-Meta-"+cseMetaAlgorithm) != "" {
+		k = &cseKey{}
+	}
+	_, compressed := uncompressedSize(info.Metadata)
+	return plainSize(info, k), compressed || k != nil, nil
+}
+
+// s3DiffItems 按 key 顺序列出对象，key 去掉 trim 前缀，列举出错时发送带 err 的条目后结束
+// sse 用于读取 SSE-C 对象的 metadata
+func s3DiffItems(ctx context.Context, client *minio.Client, bucket, prefix, trim string, sse encrypt.ServerSide) <-chan diffItem {
+	ch := make(chan diffItem)
+	go func() {
+		defer close(ch)
+		for obj := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if obj.Err != nil {
+				select {
+				case ch <- diffItem{err: obj.Err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- diffItem{
+				key:  strings.TrimPrefix(obj.Key, trim),
+				size: obj.Size,
+				etag: strings.Trim(obj.ETag, `"`),
+				stat: statFunc(ctx, client, bucket, obj.Key, sse),
+			}:
+			}
+		}
+	}()
+	return ch
+}
+
+func statFunc(ctx context.Context, client *minio.Client, bucket, key string, sse encrypt.ServerSide) func() (minio.ObjectInfo, error) {
+	return func() (minio.ObjectInfo, error) {
+		return client.StatObject(ctx, bucket, key, minio.StatObjectOptions{ServerSideEncryption: sse})
+	}
+}
+
+// localDiffItems 按 upload 的规则把本地路径转换为 key，并按 key 排序
+func localDiffItems(files []string) (<-chan diffItem, error) {
+	items := make([]diffItem, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, diffItem{
+			key:  path.Join(strings.TrimPrefix(filepath.ToSlash(file), "/")),
+			size: info.Size(),
+			path: file,
+		})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+
+	ch := make(chan diffItem)
+	go func() {
+		defer close(ch)
+		for _, item := range items {
+			ch <- item
+		}
+	}()
+	return ch, nil
+}
+
+func fileMD5(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func diffStat(size int64, meta map[string]string) func() (minio.ObjectInfo, error) {
+	return func() (minio.ObjectInfo, error) {
+		header := make(http.Header)
+		for key, value := range meta {
+			header.Set("X-Amz-Meta-"+key, value)
+		}
+		return minio.ObjectInfo{Size: size, Metadata: header}, nil
+	}
+}
+
+func TestCompareDiffItems(t *testing.T) {
+	plain := func(size int64, etag string) diffItem {
+		return diffItem{key: "k", size: size, etag: etag, stat: diffStat(size, nil)}
+	}
+	compressed := func(size int64, etag string, meta map[string]string) diffItem {
+		return diffItem{key: "k", size: size, etag: etag, stat: diffStat(size, meta)}
+	}
+	zstd := func(size string) map[string]string {
+		return map[string]string{compressMetaCodec: "zstd", compressMetaSize: size}
+	}
+	tests := []struct {
+		name     string
+		src, dst diffItem
+		want     string
+	}{
+		{"identical", plain(100, "a"), plain(100, "a"), ""},
+		{"size", plain(100, "a"), plain(101, "a"), "size"},
+		{"etag", plain(100, "a"), plain(100, "b"), "etag"},
+		// 目标压缩过，按原始大小比较，ETag 不可比
+		{"compressed same", plain(100, "a"), compressed(10, "c", zstd("100")), ""},
+		{"compressed size", plain(100, "a"), compressed(10, "c", zstd("99")), "size"},
+		{"compressed size unknown", plain(100, "a"), compressed(10, "c", map[string]string{compressMetaCodec: "zstd"}), "unverifiable"},
+		// 客户端加密的对象用 metadata 中的明文大小，没有时按算法换算
+		{"encrypted same", plain(100, "a"), compressed(cseStoredSize(&cseKey{}, 100), "c", map[string]string{cseMetaAlgorithm: cseAlgorithm, cseMetaSize: "100"}), ""},
+		{"encrypted no size", plain(100, "a"), compressed(cseStoredSize(&cseKey{}, 100), "c", map[string]string{cseMetaAlgorithm: cseAlgorithm}), ""},
+		{"encrypted size", plain(100, "a"), compressed(cseStoredSize(&cseKey{}, 100), "c", map[string]string{cseMetaAlgorithm: cseAlgorithm, cseMetaSize: "101"}), "size"},
+		// 存储的大小相同但 ETag 不同时同样检查 metadata
+		{"compressed etag", plain(10, "a"), compressed(10, "c", zstd("10")), ""},
+	}
+	for _, tt := range tests {
+		r, err := compareDiffItems(tt.src, tt.dst, false, true)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got := ""
+		if r != nil {
+			got = r.Type
+		}
+		if got != tt.want {
+			t.Errorf("%s: result = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -13,54 +14,28 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/urfave/cli/v2"
 )
 
 var download = &cli.Command{
 	Name:  "download",
-	Usage: "from http[s] download to s3",
-	Flags: []cli.Flag{
+	Usage: "from http[s] download to s3 or local dir",
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
-			Name:     "dst_endpoint",
-			EnvVars:  []string{"dst_endpoint"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_ak",
-			EnvVars:  []string{"dst_ak"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_sk",
-			EnvVars:  []string{"dst_sk"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_bucket",
-			EnvVars:  []string{"dst_bucket"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_region",
-			EnvVars:  []string{"dst_region"},
-			Required: false,
-			Hidden:   true,
-		},
-		&cli.StringFlag{
-			Name:    "dst_prefix",
-			EnvVars: []string{"dst_prefix"},
+			Name:    "filelist",
+			EnvVars: []string{"filelist"},
+			Usage:   "specify the list to be downloaded, one url per line, optionally followed by checksum (sha256:<hex>, md5:<hex>, piece cid) and size. - reads stdin, s3://bucket/key reads from the dst endpoint",
 		},
 		&cli.StringFlag{
-			Name:    "dst_bucket_lookup",
-			EnvVars: []string{"dst_bucket_lookup"},
+			Name:    "filelist_format",
+			EnvVars: []string{"filelist_format"},
 			Value:   "auto",
-			Usage:   "bucket lookup type: dns, path, auto",
+			Usage:   "filelist format: plain, csv, jsonl, auto (by file extension)",
 		},
 		&cli.StringFlag{
-			Name:    "filelist",
-			EnvVars: []string{"filelist"},
-			Usage:   "specify the list to be downloaded, one url per line",
+			Name:    "failed_list",
+			EnvVars: []string{"failed_list"},
+			Usage:   "write the entries that failed checksum or size verification to this file, in jsonl format",
 		},
 		&cli.StringFlag{
 			Name:    "PartSize",
@@ -92,6 +67,36 @@ var download = &cli.Command{
 			EnvVars: []string{"concurrent"},
 			Value:   10,
 		},
+		&cli.StringFlag{
+			Name:    "dir",
+			EnvVars: []string{"dir"},
+			Usage:   "download to this local dir instead of the dst bucket",
+		},
+		&cli.IntFlag{
+			Name:    "connections",
+			EnvVars: []string{"connections"},
+			Value:   1,
+			Usage:   "connections per file, each downloads a segment using Range",
+		},
+		&cli.StringFlag{
+			Name:    "segment_size",
+			EnvVars: []string{"segment_size"},
+			Value:   "16MiB",
+			Usage:   "segment size of multi-connection downloads, memory used per file is about connections*segment_size",
+		},
+		&cli.IntFlag{
+			Name:    "http_retries",
+			EnvVars: []string{"http_retries"},
+			Value:   5,
+			Usage:   "retries of a segment (or of the single connection) after the connection dropped, resuming from the received bytes",
+		},
+	}, append(append(append(endpointFlags("dst"), bucketFlags("dst")...), credentialFlags("dst")...), sseFlags("dst")...)...),
+	Before: func(cctx *cli.Context) error {
+		// 下载到本地目录时不需要 dst 参数
+		if cctx.String("dir") != "" {
+			return remoteBefore()(cctx)
+		}
+		return remoteBefore("dst")(cctx)
 	},
 	Action: downloadAction,
 }
@@ -99,7 +104,6 @@ var download = &cli.Command{
 func downloadAction(cctx *cli.Context) error {
 
 	dst_bucket := cctx.String("dst_bucket")
-	dst_region := cctx.String("dst_region")
 	dst_prefix := cctx.String("dst_prefix")
 
 	PartSize, err := humanize.ParseBytes(cctx.String("PartSize"))
@@ -110,32 +114,35 @@ func downloadAction(cctx *cli.Context) error {
 	ConcurrentStreamParts := cctx.Bool("EnableMemCache")
 	DisableMultipart := cctx.Bool("DisableMultipart")
 	DisableContentSha256 := cctx.Bool("DisableContentSha256")
-	disableLookupDomain = cctx.Bool("disable_lookup")
 
-	parsedDst, err := url.Parse(cctx.String("dst_endpoint"))
+	segmentSize, err := humanize.ParseBytes(cctx.String("segment_size"))
 	if err != nil {
 		return err
 	}
-	dst_endpoint := parsedDst.Host
-	dst_ssl := parsedDst.Scheme == "https"
-	dstOptions := &minio.Options{
-		Creds:     credentials.NewStaticV4(cctx.String("dst_ak"), cctx.String("dst_sk"), ""),
-		Secure:    dst_ssl,
-		Region:    dst_region,
-		Transport: transport,
+	dir := cctx.String("dir")
+	downloader := &httpDownloader{
+		client:      http.DefaultClient,
+		connections: cctx.Int("connections"),
+		segmentSize: int64(segmentSize),
+		retries:     cctx.Int("http_retries"),
 	}
 
-	// Set bucket lookup type based on the flag
-	bucketLookup := cctx.String("dst_bucket_lookup")
-	switch bucketLookup {
-	case "dns":
-		dstOptions.BucketLookup = minio.BucketLookupDNS
-	case "path":
-		dstOptions.BucketLookup = minio.BucketLookupPath
-	case "auto":
-		dstOptions.BucketLookup = minio.BucketLookupAuto
-	default:
-		return fmt.Errorf("invalid bucket_lookup value: %s, must be one of: dns, path, auto", bucketLookup)
+	// 下载到本地目录时没有 dst，文件列表也不能放在 s3 上
+	if dir != "" && strings.HasPrefix(cctx.String("filelist"), "s3://") {
+		return fmt.Errorf("filelist on s3 cannot be used with dir")
+	}
+	var dst_endpoint string
+	var dstOptions *minio.Options
+	var dst *minio.Client
+	if dir == "" {
+		dst_endpoint, dstOptions, err = newS3Options(cctx, "dst")
+		if err != nil {
+			return err
+		}
+		dst, err = minio.New(dst_endpoint, dstOptions)
+		if err != nil {
+			return err
+		}
 	}
 
 	ctx := context.Background()
@@ -144,20 +151,17 @@ func downloadAction(cctx *cli.Context) error {
 	// Create a buffered channel to manage the number of workers.
 	workerCh := make(chan struct{}, cctx.Int("concurrent"))
 
-	content, err := os.ReadFile(cctx.String("filelist"))
-	if err != nil {
-		log.Fatal(err)
-	}
-	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
-	for _, key := range lines {
+	var failed failedEntries
+	err = readFilelist(ctx, dst, cctx.String("filelist"), cctx.String("filelist_format"), true, func(entry fileEntry) error {
 		// Start a new worker.
 		wg.Add(1)
 		workerCh <- struct{}{} // Add to the worker queue.
-		go func(key string) {
+		go func(entry fileEntry) {
 			defer wg.Done()
 			defer func() {
 				<-workerCh // Remove from the worker queue.
 			}()
+			key := entry.Source
 
 			// 解析 URL
 			parsedURL, err := url.Parse(key)
@@ -165,46 +169,103 @@ func downloadAction(cctx *cli.Context) error {
 				log.Println(err)
 				return
 			}
-			// 提取路径的最后一部分
+			// 提取路径的最后一部分，文件列表中指定了 dest 时以 dest 为准
 			objectName := path.Base(parsedURL.Path)
+			if entry.Dest != "" {
+				objectName = entry.Dest
+			}
+
+			var dst *minio.Client
+			var localPath string
+			if dir != "" {
+				// dest 中的 .. 不能让文件写到 dir 之外
+				localPath, err = exportPath(dir, objectName)
+				if err != nil {
+					log.Printf("download %s failed: %s\n", key, err)
+					failed.add(entry)
+					return
+				}
+				if _, err := os.Stat(localPath); err == nil {
+					log.Printf("file %s already exists\n", localPath)
+					return
+				}
+			} else {
+				dst, err = minio.New(dst_endpoint, dstOptions)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+
+				// Check if object already exists in the destination bucket.
+				log.Printf("start StatObject %s in bucket %s\n", path.Join(dst_prefix, objectName), dst_bucket)
+				_, err = dst.StatObject(ctx, dst_bucket, path.Join(dst_prefix, objectName), minio.StatObjectOptions{ServerSideEncryption: dstSSE})
+				if err == nil {
+					log.Printf("object %s already exists in destination bucket %s\n", objectName, dst_bucket)
+					return
+				} else if !strings.Contains(err.Error(), "The specified key does not exist.") {
+					log.Println("StatObject error:", err)
+					return
+				}
+			}
 
-			dst, err := minio.New(dst_endpoint, dstOptions)
+			log.Printf("start fetch %s\n", key)
+			response, err := downloader.open(ctx, key)
 			if err != nil {
-				log.Println(err)
+				log.Println("http Get Error:", err)
 				return
 			}
+			defer response.Close()
 
-			// Check if object already exists in the destination bucket.
-			log.Printf("start StatObject %s in bucket %s\n", path.Join(dst_prefix, objectName), dst_bucket)
-			_, err = dst.StatObject(ctx, dst_bucket, path.Join(dst_prefix, objectName), minio.StatObjectOptions{})
-			if err == nil {
-				log.Printf("object %s already exists in destination bucket %s\n", objectName, dst_bucket)
-				return
-			} else if !strings.Contains(err.Error(), "The specified key does not exist.") {
-				log.Println("StatObject error:", err)
+			if entry.Size >= 0 && response.Size >= 0 && response.Size != entry.Size {
+				log.Printf("verify %s failed: size mismatch: expected %d, got Content-Length %d\n", key, entry.Size, response.Size)
+				failed.add(entry)
 				return
 			}
 
-			log.Printf("start fetch %s\n", key)
-			response, err := http.Get(key)
-			if err != nil {
-				log.Println("http Get Error:", err)
+			// 边上传边计算校验值
+			verifier := newVerifyWriter(entry.digest, entry.Size)
+			body := io.TeeReader(response, verifier)
+
+			if dir != "" {
+				log.Printf("start write %s\n", localPath)
+				if err := writeFileAtomic(localPath, body, response.Size, response.LastModified, verifier.Verify); err != nil {
+					log.Printf("download %s failed: %s\n", key, err)
+					if _, ok := err.(verifyError); ok {
+						failed.add(entry)
+					}
+					return
+				}
+				log.Printf("object %s download to %s\n", key, localPath)
 				return
 			}
-			defer response.Body.Close()
 
 			log.Printf("start upload %s to bucket %s\n", path.Join(dst_prefix, objectName), dst_bucket)
-			_, err = dst.PutObject(ctx, dst_bucket, path.Join(dst_prefix, objectName), response.Body, response.ContentLength, minio.PutObjectOptions{NumThreads: NumThreads, PartSize: PartSize, ConcurrentStreamParts: ConcurrentStreamParts, DisableMultipart: DisableMultipart, DisableContentSha256: DisableContentSha256})
+			_, err = dst.PutObject(ctx, dst_bucket, path.Join(dst_prefix, objectName), body, response.Size, minio.PutObjectOptions{ServerSideEncryption: dstSSE, UserMetadata: entry.Metadata, UserTags: entry.Tags, NumThreads: NumThreads, PartSize: PartSize, ConcurrentStreamParts: ConcurrentStreamParts, DisableMultipart: DisableMultipart, DisableContentSha256: DisableContentSha256})
 			if err != nil {
 				log.Println("PutObject error:", err)
 				return
 			}
+
+			if err := verifier.Verify(); err != nil {
+				log.Printf("verify %s failed: %s\n", key, err)
+				failed.add(entry)
+				err = dst.RemoveObject(ctx, dst_bucket, path.Join(dst_prefix, objectName), minio.RemoveObjectOptions{})
+				if err != nil {
+					log.Println("RemoveObject error:", err)
+				}
+				return
+			}
 			log.Printf("object %s download to destination bucket %s\n", path.Join(dst_prefix, objectName), dst_bucket)
 
-		}(key)
-	}
+		}(entry)
+		return nil
+	})
 
 	// Wait for all workers to finish.
 	wg.Wait()
-	return nil
+	if err != nil {
+		return err
+	}
+
+	return failed.finish(cctx.String("failed_list"))
 }
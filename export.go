@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/urfave/cli/v2"
+)
+
+var export = &cli.Command{
+	Name:  "export",
+	Usage: "from s3 export to local filesystem",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "dir",
+			EnvVars:  []string{"dir"},
+			Required: true,
+			Usage:    "local dir to export to, object key is used as the path relative to it",
+		},
+		&cli.StringFlag{
+			Name:    "filelist",
+			EnvVars: []string{"filelist"},
+			Usage:   "specify the list of keys to be exported, one object per line",
+		},
+		&cli.StringFlag{
+			Name:    "filelist_format",
+			EnvVars: []string{"filelist_format"},
+			Value:   "auto",
+			Usage:   "filelist format: auto, plain, csv, jsonl",
+		},
+		&cli.StringFlag{
+			Name:    "failed_list",
+			EnvVars: []string{"failed_list"},
+			Usage:   "write entries that failed verification to this file (jsonl)",
+		},
+		&cli.IntFlag{
+			Name:    "concurrent",
+			EnvVars: []string{"concurrent"},
+			Value:   10,
+		},
+		&cli.StringFlag{
+			Name:    "src_uuid",
+			EnvVars: []string{"src_uuid"},
+			Usage:   "src storage uuid",
+		},
+		&cli.StringFlag{
+			Name:    "dst_uuid",
+			EnvVars: []string{"dst_uuid"},
+			Usage:   "dst storage uuid, the local storage path",
+		},
+		&cli.StringFlag{
+			Name:    "rpc",
+			EnvVars: []string{"rpc"},
+			Usage:   "miner rpc, http://localhost:2345/rpc/v0",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			EnvVars: []string{"token"},
+			Usage:   "miner admin token",
+		},
+		&cli.DurationFlag{
+			Name:    "rpc_timeout",
+			EnvVars: []string{"rpc_timeout"},
+			Value:   30 * time.Second,
+			Usage:   "timeout of each miner rpc request",
+		},
+		&cli.IntFlag{
+			Name:    "rpc_retries",
+			EnvVars: []string{"rpc_retries"},
+			Value:   3,
+			Usage:   "retries of miner rpc requests on network errors and 5xx responses",
+		},
+	}, append(append(append(append(endpointFlags("src"), bucketFlags("src")...), credentialFlags("src")...), sseFlags("src")...), cseFlags("src")...)...),
+	UsageText: `
+objects are written to dir/key (or dir/dest of the filelist entry) through a temp file and renamed when complete.
+files that already exist with the same size are skipped. mtime is set to the LastModified of the object.
+with --src_cse_key_file objects are decrypted, they must have been encrypted by upload/migrate with the same master key.
+objects compressed by upload/migrate --compress are decompressed automatically.
+`,
+	Before: remoteBefore("src"),
+	Action: exportAction,
+}
+
+func exportAction(cctx *cli.Context) error {
+
+	src_bucket := cctx.String("src_bucket")
+	src_prefix := cctx.String("src_prefix")
+	dir := cctx.String("dir")
+	if dir == "" {
+		return fmt.Errorf("dir is required")
+	}
+
+	if cctx.IsSet("src_uuid") || cctx.IsSet("dst_uuid") || cctx.IsSet("rpc") || cctx.IsSet("token") {
+		srcUuid = cctx.String("src_uuid")
+		dstUuid = cctx.String("dst_uuid")
+		rpc := cctx.String("rpc")
+		token := cctx.String("token")
+		if srcUuid == "" || dstUuid == "" || rpc == "" || token == "" {
+			return fmt.Errorf("must srcUuid,dstUuid,rpc,token all set")
+		}
+		lotusApi = newLotusClient(rpc, token, cctx.Duration("rpc_timeout"), cctx.Int("rpc_retries"))
+	}
+
+	src_endpoint, srcOptions, err := newS3Options(cctx, "src")
+	if err != nil {
+		return err
+	}
+	src, err := minio.New(src_endpoint, srcOptions)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	// A wait group to manage the number of active goroutines.
+	var wg sync.WaitGroup
+	// Create a buffered channel to manage the number of workers.
+	workerCh := make(chan struct{}, cctx.Int("concurrent"))
+
+	var failed failedEntries
+	dispatch := func(object migrateObject) {
+		// Start a new worker.
+		wg.Add(1)
+		workerCh <- struct{}{} // Add to the worker queue.
+		go func(object migrateObject) {
+			defer wg.Done()
+			defer func() {
+				<-workerCh // Remove from the worker queue.
+			}()
+
+			entry := fileEntry{Size: -1}
+			if object.entry != nil {
+				entry = *object.entry
+			}
+			name := object.Key
+			if entry.Dest != "" {
+				name = entry.Dest
+			}
+			localPath, err := exportPath(dir, name)
+			if err != nil {
+				log.Printf("export %s failed: %s\n", object.Key, err)
+				failed.add(entry)
+				return
+			}
+
+			// 来自文件列表的对象没有 size、LastModified 和 metadata
+			if object.LastModified.IsZero() {
+				info, err := src.StatObject(ctx, src_bucket, object.Key, minio.StatObjectOptions{ServerSideEncryption: srcSSE})
+				if err != nil {
+					log.Println("StatObject error:", err)
+					return
+				}
+				object.ObjectInfo = info
+			}
+			// 客户端加密、压缩的对象比较原始内容的大小，size 为 -1 表示未知
+			size := csePlainSize(srcCSE, object.Size)
+			if s, compressed := uncompressedSize(object.Metadata); compressed {
+				size = s
+			}
+			if entry.Size >= 0 && size >= 0 && size != entry.Size {
+				log.Printf("verify %s failed: size mismatch: expected %d, got %d\n", object.Key, entry.Size, size)
+				failed.add(entry)
+				return
+			}
+
+			if stat, err := os.Stat(localPath); err == nil {
+				// 列出的对象没有 metadata，大小不同时可能是压缩过的对象
+				if stat.Size() != size && object.Metadata == nil {
+					info, err := src.StatObject(ctx, src_bucket, object.Key, minio.StatObjectOptions{ServerSideEncryption: srcSSE})
+					if err != nil {
+						log.Println("StatObject error:", err)
+						return
+					}
+					if s, compressed := uncompressedSize(info.Metadata); compressed {
+						size = s
+					}
+				}
+				if stat.Size() == size {
+					log.Printf("file %s already exists with the same size\n", localPath)
+					return
+				}
+			}
+
+			log.Printf("start GetObject %s in bucket %s\n", object.Key, src_bucket)
+			reader, err := src.GetObject(ctx, src_bucket, object.Key, minio.GetObjectOptions{ServerSideEncryption: srcSSE})
+			if err != nil {
+				log.Println("GetObject error:", err)
+				return
+			}
+			defer reader.Close()
+
+			info, err := reader.Stat()
+			if err != nil {
+				log.Println("Stat error:", err)
+				return
+			}
+			body, size, err := decodeObject(reader, info)
+			if err != nil {
+				log.Printf("decode %s failed: %s\n", object.Key, err)
+				return
+			}
+			defer body.Close()
+
+			verifier := newVerifyWriter(entry.digest, entry.Size)
+			log.Printf("start export %s to %s\n", object.Key, localPath)
+			if err := writeFileAtomic(localPath, io.TeeReader(body, verifier), size, object.LastModified, verifier.Verify); err != nil {
+				log.Printf("export %s failed: %s\n", object.Key, err)
+				if _, ok := err.(verifyError); ok {
+					failed.add(entry)
+				}
+				return
+			}
+			log.Printf("object %s exported to %s\n", object.Key, localPath)
+
+			if srcUuid != "" {
+				file, err := parseSectorKey(object.Key)
+				if err != nil {
+					log.Println("changeStorage error:", err)
+					return
+				}
+				// cache 目录全部导出完成后才重新声明，且只声明一次
+				declare := true
+				if file.isDir() {
+					declare, err = sectorDirExported(ctx, src, src_bucket, file.Path, dir)
+					if err != nil {
+						log.Println("changeStorage error:", err)
+						return
+					}
+					if !declare {
+						log.Printf("wait for the remaining files of %s before changeStorage\n", file.Path)
+					} else {
+						declare = claimSectorDir(file.Path)
+					}
+				}
+				if declare {
+					err = changeStorage(ctx, file, srcUuid, dstUuid)
+					if err != nil {
+						log.Println("changeStorage error:", err)
+						return
+					}
+				}
+			}
+		}(object)
+	}
+
+	if cctx.IsSet("filelist") {
+		err = readFilelist(ctx, src, cctx.String("filelist"), cctx.String("filelist_format"), false, func(entry fileEntry) error {
+			dispatch(migrateObject{ObjectInfo: minio.ObjectInfo{Key: entry.Source}, entry: &entry})
+			return nil
+		})
+	} else {
+		for obj := range src.ListObjects(ctx, src_bucket, minio.ListObjectsOptions{Prefix: src_prefix, Recursive: true}) {
+			if obj.Err != nil {
+				err = fmt.Errorf("ListObjects error: %w", obj.Err)
+				break
+			}
+			dispatch(migrateObject{ObjectInfo: obj})
+		}
+	}
+
+	// Wait for all workers to finish.
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return failed.finish(cctx.String("failed_list"))
+}
+
+// verifyError 校验失败，区别于读写错误
+type verifyError struct{ error }
+
+// exportPath 返回 key 在本地目录 dir 下的路径，key 中的 .. 或绝对路径使结果不在 dir 下时报错
+func exportPath(dir, key string) (string, error) {
+	localPath := filepath.Join(dir, filepath.FromSlash(key))
+	rel, err := filepath.Rel(dir, localPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("path %q is outside of %s", key, dir)
+	}
+	return localPath, nil
+}
+
+// writeFileAtomic 先写到同目录下的隐藏临时文件，大小和 verify 都通过后设置 mtime 再改名，中断时不会留下不完整的文件
+func writeFileAtomic(name string, r io.Reader, size int64, mtime time.Time, verify func() error) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return verifyError{fmt.Errorf("size mismatch: expected %d, got %d", size, n)}
+	}
+	if verify != nil {
+		if err := verify(); err != nil {
+			return verifyError{err}
+		}
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if !mtime.IsZero() {
+		if err := os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), name)
+}
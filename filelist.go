@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// fileEntry 文件列表中的一条记录
+// Source 按命令不同分别是 object key、url 或本地路径；Dest 为空时由各命令按原有规则生成目标 key
+type fileEntry struct {
+	Source   string
+	Dest     string
+	Size     int64 // 小于 0 表示不校验大小
+	Checksum string
+	Metadata map[string]string
+	Tags     map[string]string
+	Priority int // migrate --schedule priority 时数值大的先派发
+
+	digest *expectedDigest
+}
+
+// 文件列表格式
+const (
+	filelistAuto  = "auto"
+	filelistPlain = "plain"
+	filelistCSV   = "csv"
+	filelistJSONL = "jsonl"
+)
+
+// readFilelist 逐条读取文件列表并回调 fn，不会把整个列表读入内存
+// name 为 - 时读标准输入，为 s3://bucket/key 时通过 client 读取对象，否则为本地文件
+// plain 格式每行一条记录，忽略空行和 # 开头的注释；splitFields 为 true 时行内可追加空格分隔的 checksum 和 size
+// csv 格式第一行为表头，jsonl 格式每行一个 json 对象，字段见 fileEntry
+func readFilelist(ctx context.Context, client *minio.Client, name, format string, splitFields bool, fn func(fileEntry) error) error {
+	f, err := openFilelist(ctx, client, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if format == "" || format == filelistAuto {
+		format = detectFilelistFormat(name)
+	}
+	switch format {
+	case filelistPlain:
+		return readPlainFilelist(f, splitFields, fn)
+	case filelistCSV:
+		return readCSVFilelist(f, fn)
+	case filelistJSONL:
+		return readJSONLFilelist(f, fn)
+	default:
+		return fmt.Errorf("invalid filelist_format value: %s, must be one of: auto, plain, csv, jsonl", format)
+	}
+}
+
+func openFilelist(ctx context.Context, client *minio.Client, name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	if strings.HasPrefix(name, "s3://") {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(name, "s3://"), "/")
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("invalid filelist %s, must be s3://bucket/key", name)
+		}
+		if client == nil {
+			return nil, fmt.Errorf("filelist %s on s3 needs the s3 endpoint", name)
+		}
+		obj, err := client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+		// GetObject 是惰性的，先 Stat 一次让不存在等错误尽早暴露
+		if _, err := obj.Stat(); err != nil {
+			obj.Close()
+			return nil, fmt.Errorf("read filelist %s: %w", name, err)
+		}
+		return obj, nil
+	}
+	return os.Open(name)
+}
+
+func detectFilelistFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return filelistCSV
+	case ".jsonl", ".ndjson", ".json":
+		return filelistJSONL
+	default:
+		return filelistPlain
+	}
+}
+
+func readPlainFilelist(r io.Reader, splitFields bool, fn func(fileEntry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry := fileEntry{Source: line, Size: -1}
+		if splitFields {
+			fields := strings.Fields(line)
+			entry.Source = fields[0]
+			for _, field := range fields[1:] {
+				if n, err := strconv.ParseInt(field, 10, 64); err == nil {
+					entry.Size = n
+					continue
+				}
+				entry.Checksum = field
+			}
+		}
+		if err := finishEntry(&entry, lineNum, fn); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func readCSVFilelist(r io.Reader, fn func(fileEntry) error) error {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	columns := make([]string, len(header))
+	for i, name := range header {
+		columns[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lineNum, _ := reader.FieldPos(0)
+
+		entry := fileEntry{Size: -1}
+		for i, value := range record {
+			if i >= len(columns) {
+				break
+			}
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			switch columns[i] {
+			case "source", "key", "url", "path":
+				entry.Source = value
+			case "dest":
+				entry.Dest = value
+			case "size":
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return fmt.Errorf("filelist line %d: invalid size %q", lineNum, value)
+				}
+				entry.Size = n
+			case "checksum":
+				entry.Checksum = value
+			case "metadata":
+				entry.Metadata = parseKeyValues(value)
+			case "tags":
+				entry.Tags = parseKeyValues(value)
+			case "priority":
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return fmt.Errorf("filelist line %d: invalid priority %q", lineNum, value)
+				}
+				entry.Priority = n
+			}
+		}
+		if err := finishEntry(&entry, lineNum, fn); err != nil {
+			return err
+		}
+	}
+}
+
+// jsonEntry 为 jsonl 格式的一行，source 也可以写成 key、url 或 path
+type jsonEntry struct {
+	Source   string            `json:"source,omitempty"`
+	Key      string            `json:"key,omitempty"`
+	URL      string            `json:"url,omitempty"`
+	Path     string            `json:"path,omitempty"`
+	Dest     string            `json:"dest,omitempty"`
+	Size     *int64            `json:"size,omitempty"`
+	Checksum string            `json:"checksum,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+}
+
+func readJSONLFilelist(r io.Reader, fn func(fileEntry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var je jsonEntry
+		if err := json.Unmarshal([]byte(line), &je); err != nil {
+			return fmt.Errorf("filelist line %d: %w", lineNum, err)
+		}
+		entry := fileEntry{
+			Source:   firstNonEmpty(je.Source, je.Key, je.URL, je.Path),
+			Dest:     je.Dest,
+			Size:     -1,
+			Checksum: je.Checksum,
+			Metadata: je.Metadata,
+			Tags:     je.Tags,
+			Priority: je.Priority,
+		}
+		if je.Size != nil {
+			entry.Size = *je.Size
+		}
+		if err := finishEntry(&entry, lineNum, fn); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func finishEntry(entry *fileEntry, lineNum int, fn func(fileEntry) error) error {
+	if entry.Source == "" {
+		return fmt.Errorf("filelist line %d: missing source", lineNum)
+	}
+	if entry.Checksum != "" {
+		digest, err := parseDigest(entry.Checksum)
+		if err != nil {
+			return fmt.Errorf("filelist line %d: %w", lineNum, err)
+		}
+		entry.digest = digest
+	}
+	return fn(*entry)
+}
+
+// parseKeyValues 解析 k1=v1;k2=v2 形式的 metadata / tags
+func parseKeyValues(s string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		k, v, _ := strings.Cut(kv, "=")
+		if k = strings.TrimSpace(k); k != "" {
+			m[k] = strings.TrimSpace(v)
+		}
+	}
+	return m
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// failedEntries 收集校验失败的记录，结束时以 jsonl 格式写入 failed_list，可直接作为 filelist 重跑
+type failedEntries struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (f *failedEntries) add(entry fileEntry) {
+	je := jsonEntry{
+		Source:   entry.Source,
+		Dest:     entry.Dest,
+		Checksum: entry.Checksum,
+		Metadata: entry.Metadata,
+		Tags:     entry.Tags,
+		Priority: entry.Priority,
+	}
+	if entry.Size >= 0 {
+		je.Size = &entry.Size
+	}
+	line, _ := json.Marshal(je)
+
+	f.mu.Lock()
+	f.lines = append(f.lines, string(line))
+	f.mu.Unlock()
+}
+
+func (f *failedEntries) finish(failedList string) error {
+	if len(f.lines) == 0 {
+		return nil
+	}
+	if failedList != "" {
+		err := os.WriteFile(failedList, []byte(strings.Join(f.lines, "\n")+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("%d entries failed verification", len(f.lines))
+}
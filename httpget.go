@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpDownloader 分段多连接下载：每个文件用 connections 个连接按 Range 并发下载 segmentSize 大小的分段，
+// 按顺序输出，因此可以直接作为 PutObject 的 body。分段失败时从已收到的位置续传，
+// 续传请求带 If-Range，源文件在下载过程中发生变化（ETag/Last-Modified 不一致）时报错
+type httpDownloader struct {
+	client      *http.Client
+	connections int
+	segmentSize int64
+	retries     int
+}
+
+// httpBody 下载的内容，Size 为 -1 表示长度未知
+type httpBody struct {
+	io.ReadCloser
+	Size         int64
+	LastModified time.Time
+}
+
+// errSourceChanged 源文件在下载过程中发生了变化
+var errSourceChanged = errors.New("source changed during download")
+
+func (d *httpDownloader) open(ctx context.Context, url string) (*httpBody, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 多连接时先请求第一个字节，确认源支持 Range 并拿到文件大小
+	if d.connections > 1 {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// 空文件没有第一个字节，返回 416 和 Content-Range: bytes */0
+	if d.connections > 1 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		if size, err := contentRangeSize(resp.Header.Get("Content-Range")); err != nil || size != 0 {
+			return nil, fmt.Errorf("http status: %s", resp.Status)
+		}
+		lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &httpBody{ReadCloser: http.NoBody, Size: 0, LastModified: lastModified}, nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("http status: %s", resp.Status)
+	}
+
+	v := validator{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}
+	lastModified, _ := http.ParseTime(v.lastModified)
+
+	if resp.StatusCode == http.StatusPartialContent {
+		resp.Body.Close()
+		size, err := contentRangeSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		return &httpBody{ReadCloser: d.segmented(ctx, url, size, v), Size: size, LastModified: lastModified}, nil
+	}
+
+	// 单连接，或源不支持 Range（返回了 200）：直接使用这个响应，支持 Range 时出错可以续传
+	body := &resumingReader{
+		ctx:     ctx,
+		client:  d.client,
+		url:     url,
+		v:       v,
+		body:    resp.Body,
+		end:     resp.ContentLength - 1,
+		retries: d.retries,
+		resume:  resp.Header.Get("Accept-Ranges") == "bytes" && resp.ContentLength >= 0,
+	}
+	return &httpBody{ReadCloser: body, Size: resp.ContentLength, LastModified: lastModified}, nil
+}
+
+// validator 用于 If-Range 和分段之间的一致性检查
+type validator struct {
+	etag         string
+	lastModified string
+}
+
+func (v validator) ifRange() string {
+	// 弱 ETag 不能用于 If-Range
+	if v.etag != "" && !strings.HasPrefix(v.etag, "W/") {
+		return v.etag
+	}
+	return v.lastModified
+}
+
+func (v validator) check(resp *http.Response) error {
+	if v.etag != "" && resp.Header.Get("ETag") != "" && resp.Header.Get("ETag") != v.etag {
+		return errSourceChanged
+	}
+	if v.lastModified != "" && resp.Header.Get("Last-Modified") != "" && resp.Header.Get("Last-Modified") != v.lastModified {
+		return errSourceChanged
+	}
+	return nil
+}
+
+// contentRangeSize 解析 Content-Range: bytes 0-0/1234 中的总大小
+func contentRangeSize(s string) (int64, error) {
+	_, total, ok := strings.Cut(s, "/")
+	if !ok || total == "*" {
+		return 0, fmt.Errorf("invalid Content-Range: %q", s)
+	}
+	return strconv.ParseInt(total, 10, 64)
+}
+
+// rangeRequest 请求 [start, end] 区间，源不再是同一个文件时返回 errSourceChanged
+func rangeRequest(ctx context.Context, client *http.Client, url string, v validator, start, end int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if end >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+	if ifRange := v.ifRange(); ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		// If-Range 不匹配时服务端返回 200 和完整内容
+		if resp.StatusCode == http.StatusOK {
+			return nil, errSourceChanged
+		}
+		return nil, fmt.Errorf("http status: %s", resp.Status)
+	}
+	if err := v.check(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// resumingReader 单连接读取，读取出错时从当前位置发起 Range 请求续传
+type resumingReader struct {
+	ctx     context.Context
+	client  *http.Client
+	url     string
+	v       validator
+	body    io.ReadCloser
+	offset  int64
+	end     int64
+	retries int
+	resume  bool
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for attempt := 0; ; attempt++ {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF || !r.resume || attempt >= r.retries || r.ctx.Err() != nil {
+			return n, err
+		}
+		if n > 0 {
+			// 先把已经读到的数据返回，下一次 Read 会再次遇到错误并续传
+			return n, nil
+		}
+
+		log.Printf("read %s failed at %d: %s, resume (%d/%d)\n", r.url, r.offset, err, attempt+1, r.retries)
+		r.body.Close()
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+		resp, rerr := rangeRequest(r.ctx, r.client, r.url, r.v, r.offset, r.end)
+		if rerr != nil {
+			if rerr == errSourceChanged {
+				return 0, rerr
+			}
+			r.body = io.NopCloser(&errReader{err: rerr})
+			continue
+		}
+		r.body = resp.Body
+	}
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+type segmentResult struct {
+	data []byte
+	err  error
+}
+
+// segmentedReader 按顺序输出并发下载的分段，同时最多有 connections 个分段在下载或等待读取
+type segmentedReader struct {
+	cancel  context.CancelFunc
+	pending chan chan segmentResult
+	sem     chan struct{}
+	buf     []byte
+	err     error
+}
+
+func (d *httpDownloader) segmented(ctx context.Context, url string, size int64, v validator) *segmentedReader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &segmentedReader{
+		cancel:  cancel,
+		pending: make(chan chan segmentResult, d.connections),
+		sem:     make(chan struct{}, d.connections),
+	}
+	go func() {
+		defer close(r.pending)
+		for start := int64(0); start < size; start += d.segmentSize {
+			end := start + d.segmentSize - 1
+			if end >= size {
+				end = size - 1
+			}
+			select {
+			case r.sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			ch := make(chan segmentResult, 1)
+			go func(start, end int64) {
+				data, err := d.fetchSegment(ctx, url, v, start, end)
+				ch <- segmentResult{data: data, err: err}
+			}(start, end)
+			r.pending <- ch
+		}
+	}()
+	return r
+}
+
+// fetchSegment 下载一个分段，出错时从已收到的位置重试
+func (d *httpDownloader) fetchSegment(ctx context.Context, url string, v validator, start, end int64) ([]byte, error) {
+	data := make([]byte, 0, end-start+1)
+	var err error
+	for attempt := 0; attempt <= d.retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("fetch %s bytes %d-%d failed: %s, resume from %d (%d/%d)\n", url, start, end, err, start+int64(len(data)), attempt, d.retries)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+
+		var resp *http.Response
+		resp, err = rangeRequest(ctx, d.client, url, v, start+int64(len(data)), end)
+		if err != nil {
+			if err == errSourceChanged {
+				return nil, err
+			}
+			continue
+		}
+		var n int64
+		n, err = io.Copy(sliceWriter{&data}, io.LimitReader(resp.Body, end-start+1-int64(len(data))))
+		resp.Body.Close()
+		if err == nil && int64(len(data)) == end-start+1 {
+			return data, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("short read: %d bytes", n)
+		}
+	}
+	return nil, err
+}
+
+type sliceWriter struct{ b *[]byte }
+
+func (w sliceWriter) Write(p []byte) (int, error) {
+	*w.b = append(*w.b, p...)
+	return len(p), nil
+}
+
+func (r *segmentedReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		ch, ok := <-r.pending
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		res := <-ch
+		<-r.sem
+		if res.err != nil {
+			r.err = res.err
+			r.cancel()
+			continue
+		}
+		r.buf = res.data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *segmentedReader) Close() error {
+	r.cancel()
+	// 释放还在等待的分段，让生产者退出
+	go func() {
+		for ch := range r.pending {
+			<-ch
+			<-r.sem
+		}
+	}()
+	return nil
+}
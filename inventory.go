@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/minio/minio-go/v7"
+	"github.com/urfave/cli/v2"
+)
+
+var inventory = &cli.Command{
+	Name:  "inventory",
+	Usage: "list a bucket into a manifest and print a summary",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			EnvVars: []string{"output"},
+			Usage:   "write the manifest to this file, - for stdout, empty to only print the summary",
+		},
+		&cli.StringFlag{
+			Name:    "format",
+			EnvVars: []string{"format"},
+			Value:   "csv",
+			Usage:   "manifest format: csv, jsonl",
+		},
+		&cli.IntFlag{
+			Name:    "depth",
+			EnvVars: []string{"depth"},
+			Value:   1,
+			Usage:   "number of key path segments used for the per-prefix breakdown",
+		},
+	}, append(append(endpointFlags("src"), bucketFlags("src")...), credentialFlags("src")...)...),
+	Before: remoteBefore("src"),
+	Action: inventoryAction,
+}
+
+// 文件大小直方图的分档上限，覆盖常见的小文件和 32/64 GiB 扇区文件
+var inventoryBuckets = []uint64{
+	humanize.KiByte,
+	humanize.MiByte,
+	16 * humanize.MiByte,
+	128 * humanize.MiByte,
+	humanize.GiByte,
+	8 * humanize.GiByte,
+	32 * humanize.GiByte,
+	64 * humanize.GiByte,
+}
+
+type inventoryStat struct {
+	Count int64
+	Size  int64
+}
+
+type inventorySummary struct {
+	Total        inventoryStat
+	Histogram    []inventoryStat
+	Prefixes     map[string]*inventoryStat
+	StorageClass map[string]*inventoryStat
+	Oldest       minio.ObjectInfo
+	Newest       minio.ObjectInfo
+}
+
+func inventoryAction(cctx *cli.Context) error {
+	src_bucket := cctx.String("src_bucket")
+	src_prefix := cctx.String("src_prefix")
+	depth := cctx.Int("depth")
+
+	src_endpoint, srcOptions, err := newS3Options(cctx, "src")
+	if err != nil {
+		return err
+	}
+
+	var manifest manifestWriter
+	if output := cctx.String("output"); output != "" {
+		var w io.Writer = os.Stdout
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		manifest, err = newManifestWriter(w, cctx.String("format"))
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	s3SrcClient, err := minio.New(src_endpoint, srcOptions)
+	if err != nil {
+		return err
+	}
+
+	summary := &inventorySummary{
+		Histogram:    make([]inventoryStat, len(inventoryBuckets)+1),
+		Prefixes:     make(map[string]*inventoryStat),
+		StorageClass: make(map[string]*inventoryStat),
+	}
+	objectsCh := s3SrcClient.ListObjects(ctx, src_bucket, minio.ListObjectsOptions{
+		Prefix:    src_prefix,
+		Recursive: true,
+	})
+	for obj := range objectsCh {
+		if obj.Err != nil {
+			return fmt.Errorf("ListObjects error: %w", obj.Err)
+		}
+		if manifest != nil {
+			if err := manifest.Write(obj); err != nil {
+				return err
+			}
+		}
+		summary.add(obj, depth)
+	}
+	if manifest != nil {
+		if err := manifest.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// manifest 输出到 stdout 时，summary 打到 stderr，避免混在一起
+	var out io.Writer = os.Stdout
+	if cctx.String("output") == "-" {
+		out = os.Stderr
+	}
+	summary.print(out)
+	return nil
+}
+
+func (s *inventorySummary) add(obj minio.ObjectInfo, depth int) {
+	s.Total.Count++
+	s.Total.Size += obj.Size
+
+	i := sort.Search(len(inventoryBuckets), func(i int) bool { return uint64(obj.Size) < inventoryBuckets[i] })
+	s.Histogram[i].Count++
+	s.Histogram[i].Size += obj.Size
+
+	addStat(s.Prefixes, keyPrefix(obj.Key, depth), obj.Size)
+	storageClass := obj.StorageClass
+	if storageClass == "" {
+		storageClass = "STANDARD"
+	}
+	addStat(s.StorageClass, storageClass, obj.Size)
+
+	if s.Oldest.Key == "" || obj.LastModified.Before(s.Oldest.LastModified) {
+		s.Oldest = obj
+	}
+	if s.Newest.Key == "" || obj.LastModified.After(s.Newest.LastModified) {
+		s.Newest = obj
+	}
+}
+
+func (s *inventorySummary) print(w io.Writer) {
+	fmt.Fprintf(w, "objects: %d, total size: %s\n", s.Total.Count, humanize.IBytes(uint64(s.Total.Size)))
+	if s.Total.Count == 0 {
+		return
+	}
+	fmt.Fprintf(w, "oldest: %s %s\n", s.Oldest.LastModified.Format(time.RFC3339), s.Oldest.Key)
+	fmt.Fprintf(w, "newest: %s %s\n", s.Newest.LastModified.Format(time.RFC3339), s.Newest.Key)
+
+	fmt.Fprintln(w, "\nsize histogram:")
+	for i, stat := range s.Histogram {
+		var label string
+		if i < len(inventoryBuckets) {
+			label = "< " + humanize.IBytes(inventoryBuckets[i])
+		} else {
+			label = ">= " + humanize.IBytes(inventoryBuckets[i-1])
+		}
+		fmt.Fprintf(w, "  %-12s %10d  %s\n", label, stat.Count, humanize.IBytes(uint64(stat.Size)))
+	}
+
+	fmt.Fprintln(w, "\nstorage class:")
+	printStats(w, s.StorageClass)
+	fmt.Fprintln(w, "\nprefix:")
+	printStats(w, s.Prefixes)
+}
+
+func addStat(m map[string]*inventoryStat, name string, size int64) {
+	stat, ok := m[name]
+	if !ok {
+		stat = &inventoryStat{}
+		m[name] = stat
+	}
+	stat.Count++
+	stat.Size += size
+}
+
+func printStats(w io.Writer, m map[string]*inventoryStat) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-40s %10d  %s\n", name, m[name].Count, humanize.IBytes(uint64(m[name].Size)))
+	}
+}
+
+// keyPrefix 取 key 的前 depth 段路径，不含目录的 key 归到 "/"
+func keyPrefix(key string, depth int) string {
+	parts := strings.Split(key, "/")
+	if len(parts) <= 1 || depth <= 0 {
+		return "/"
+	}
+	if depth > len(parts)-1 {
+		depth = len(parts) - 1
+	}
+	return strings.Join(parts[:depth], "/") + "/"
+}
+
+// manifestWriter 输出清单，格式与 filelist 兼容，可直接作为 --filelist 使用
+type manifestWriter interface {
+	Write(obj minio.ObjectInfo) error
+	Flush() error
+}
+
+func newManifestWriter(w io.Writer, format string) (manifestWriter, error) {
+	switch format {
+	case filelistCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write([]string{"key", "size", "etag", "last_modified", "storage_class"})
+		return &csvManifest{w: cw}, err
+	case filelistJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonlManifest{w: bw, enc: json.NewEncoder(bw)}, nil
+	default:
+		return nil, fmt.Errorf("invalid format value: %s, must be one of: csv, jsonl", format)
+	}
+}
+
+type csvManifest struct {
+	w *csv.Writer
+}
+
+func (m *csvManifest) Write(obj minio.ObjectInfo) error {
+	return m.w.Write([]string{
+		obj.Key,
+		strconv.FormatInt(obj.Size, 10),
+		obj.ETag,
+		obj.LastModified.UTC().Format(time.RFC3339),
+		obj.StorageClass,
+	})
+}
+
+func (m *csvManifest) Flush() error {
+	m.w.Flush()
+	return m.w.Error()
+}
+
+type jsonlManifest struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+type manifestLine struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+	StorageClass string    `json:"storage_class,omitempty"`
+}
+
+func (m *jsonlManifest) Write(obj minio.ObjectInfo) error {
+	return m.enc.Encode(manifestLine{
+		Key:          obj.Key,
+		Size:         obj.Size,
+		ETag:         obj.ETag,
+		LastModified: obj.LastModified.UTC(),
+		StorageClass: obj.StorageClass,
+	})
+}
+
+func (m *jsonlManifest) Flush() error {
+	return m.w.Flush()
+}
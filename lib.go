@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
@@ -12,182 +10,225 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/filecoin-project/go-address"
+	"github.com/minio/minio-go/v7"
+	"github.com/urfave/cli/v2"
 )
 
-var srcUuid, dstUuid, rpc, token string
-var disableLookupDomain bool
+var srcUuid, dstUuid string
+var lotusApi *lotusClient
 var mutex = &sync.Mutex{}
 
-var transport = &randomRoundTripper{
-	resolver: net.DefaultResolver,
-}
+// pools 按 endpoint 列表缓存的节点池，同一集群的多个 client 共用健康状态
+var pools = make(map[string]*endpointPool)
 
-func nslookupShuf(input string) string {
-	if disableLookupDomain {
-		return input
-	}
-	parsedURL, err := url.Parse("http://" + input)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	host := parsedURL.Hostname()
-	port := parsedURL.Port()
-	addrs, err := net.LookupIP(host)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	var ipv4Addrs []string
-	for _, addr := range addrs {
-		if ipv4 := addr.To4(); ipv4 != nil {
-			ipv4Addrs = append(ipv4Addrs, ipv4.String())
-		}
-	}
+// transport 所有 s3 client 共用的 Transport，首次使用时按 --random_ip 创建
+var transport *http.Transport
 
-	// 设置随机数种子
+func getTransport(cctx *cli.Context) *http.Transport {
 	mutex.Lock()
-	rand.Seed(time.Now().UnixNano())
-	mutex.Unlock()
-	// 从 IP 列表中随机选择一个 IP
-	randomIndex := rand.Intn(len(ipv4Addrs))
-	randomIP := ipv4Addrs[randomIndex]
-
-	if port == "" {
-		return fmt.Sprint(randomIP)
-	} else {
-		return fmt.Sprintf("%s:%s", randomIP, port)
+	defer mutex.Unlock()
+	if transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		// 兼容原来的环境变量 USE_RANDOM_IP，非空即开启
+		if cctx.Bool("random_ip") || os.Getenv("USE_RANDOM_IP") != "" {
+			t.DialContext = randomIPDialContext(net.DefaultResolver)
+		}
+		transport = t
 	}
+	return transport
 }
 
-type randomRoundTripper struct {
-	resolver *net.Resolver
-}
+// randomIPDialContext 每次建立连接时解析域名并随机选择一个 IP（IPv4 或 IPv6），连接失败时依次尝试其它 IP
+// 主要是为了局域网内传输加速使用。只替换拨号地址，URL 不变，因此 https 的 SNI、证书校验和签名用的 Host 都不受影响
+func randomIPDialContext(resolver *net.Resolver) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
 
-func (r *randomRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	// 不使用随机IP请求，使用默认的 Transport
-	if os.Getenv("USE_RANDOM_IP") == "" {
-		return http.DefaultTransport.RoundTrip(req)
-	}
+		ipNetwork := "ip"
+		switch network {
+		case "tcp4":
+			ipNetwork = "ip4"
+		case "tcp6":
+			ipNetwork = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, ipNetwork, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no address found for %s", host)
+		}
+		rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
 
-	// 下方主要是为了局域网内传输加速使用
-	// 如果用了随机IP，还是https的endpoint，会有证书问题
-	// 解析域名，获取所有 IPV4 地址
-	ips, err := r.resolver.LookupIP(context.Background(), "ip4", req.URL.Hostname())
-	if err != nil {
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
 		return nil, err
 	}
+}
 
-	// 随机选择一个 IP 地址
-	selectedIP := ips[rand.Intn(len(ips))]
-
-	// 替换请求的 Host 字段为选定的 ip 或 ip:port
-	if port := req.URL.Port(); port == "" {
-		if req.URL.Scheme == "https" {
-			req.URL.Host = selectedIP.String() + ":443"
-		} else {
-			req.URL.Host = selectedIP.String() + ":80"
-		}
-	} else {
-		req.URL.Host = selectedIP.String() + ":" + port
+// endpointFlags 每一端的连接参数：config 中的 remote、endpoint、ak/sk、region、bucket_lookup
+func endpointFlags(sides ...string) []cli.Flag {
+	var flags []cli.Flag
+	for _, side := range sides {
+		flags = append(flags,
+			&cli.StringFlag{
+				Name:    side,
+				EnvVars: []string{side},
+				Usage:   side + " remote from the config file, ~/.mc/config.json or ~/.aws/credentials, remote:bucket[/prefix]",
+			},
+			&cli.StringFlag{
+				Name:    side + "_endpoint",
+				EnvVars: []string{side + "_endpoint"},
+			},
+			&cli.StringFlag{
+				Name:    side + "_ak",
+				EnvVars: []string{side + "_ak"},
+			},
+			&cli.StringFlag{
+				Name:    side + "_sk",
+				EnvVars: []string{side + "_sk"},
+			},
+			&cli.StringFlag{
+				Name:     side + "_region",
+				EnvVars:  []string{side + "_region"},
+				Required: false,
+				Hidden:   true,
+			},
+			&cli.StringFlag{
+				Name:    side + "_bucket_lookup",
+				EnvVars: []string{side + "_bucket_lookup"},
+				Value:   "auto",
+				Usage:   "bucket lookup type: dns, path, auto",
+			},
+		)
 	}
-
-	// 使用默认的 Transport 进行实际的请求
-	return http.DefaultTransport.RoundTrip(req)
+	return flags
 }
 
-// 根据object key（filename），在目标位置声明，在原位置删除
-func changeStorage(object string, srcUuid string, dstUuid string) error {
-	re := regexp.MustCompile(`.*s-(t\d+)-(\d+)`)
-	match := re.FindStringSubmatch(object)
-	if len(match) != 3 {
-		return fmt.Errorf("to abi.SectorID failed, input type error")
+// bucketFlags 每一端的 bucket 和 prefix 参数
+func bucketFlags(sides ...string) []cli.Flag {
+	var flags []cli.Flag
+	for _, side := range sides {
+		flags = append(flags,
+			&cli.StringFlag{
+				Name:    side + "_bucket",
+				EnvVars: []string{side + "_bucket"},
+			},
+			&cli.StringFlag{
+				Name:    side + "_prefix",
+				EnvVars: []string{side + "_prefix"},
+			},
+		)
 	}
-	minerAdd := match[1]
-	sectorNum := match[2]
+	return flags
+}
 
-	addr, err := address.NewFromString(minerAdd)
+// newS3Options 根据 <side>_endpoint、<side>_region、<side>_bucket_lookup 和凭证参数构造 minio.Options
+// side 为 src 或 dst，返回值中的 endpoint 为去掉 scheme 的 host[:port]
+func newS3Options(cctx *cli.Context, side string) (string, *minio.Options, error) {
+	endpoints, err := parseEndpoints(cctx.String(side + "_endpoint"))
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	mid, err := address.IDFromAddress(addr)
-	if err != nil {
-		return err
+	parsed := endpoints[0]
+	base := getTransport(cctx)
+	if tlsConfig := remoteTLS[side]; tlsConfig != nil {
+		base = base.Clone()
+		base.TLSClientConfig = tlsConfig
 	}
-	snum, err := strconv.ParseUint(sectorNum, 10, 64)
+
+	creds, err := newCredentials(cctx, side, parsed.Scheme+"://"+parsed.Host, base)
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+	options := &minio.Options{
+		Creds:     creds,
+		Secure:    parsed.Scheme == "https",
+		Region:    cctx.String(side + "_region"),
+		Transport: base,
 	}
 
-	client := &http.Client{}
-	request := func(payload map[string]interface{}) error {
-		payloadBytes, err := json.Marshal(payload)
-		if err != nil {
-			return fmt.Errorf("error encoding JSON: %s", err)
-		}
-
-		req, err := http.NewRequest("POST", rpc, bytes.NewBuffer(payloadBytes))
+	// 多个 endpoint 或开启 dns_pool 时使用节点池
+	if len(endpoints) > 1 || cctx.Bool("dns_pool") {
+		pool, err := getEndpointPool(cctx, side, endpoints, base)
 		if err != nil {
-			return fmt.Errorf("error creating HTTP request: %s", err)
+			return "", nil, err
 		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		options.Transport = pool
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			return fmt.Errorf("error sending request: %s", err)
-		}
-		defer resp.Body.Close()
+	// Set bucket lookup type based on the flag
+	bucketLookup := cctx.String(side + "_bucket_lookup")
+	switch bucketLookup {
+	case "dns":
+		options.BucketLookup = minio.BucketLookupDNS
+	case "path":
+		options.BucketLookup = minio.BucketLookupPath
+	case "auto":
+		options.BucketLookup = minio.BucketLookupAuto
+	default:
+		return "", nil, fmt.Errorf("invalid bucket_lookup value: %s, must be one of: dns, path, auto", bucketLookup)
+	}
+	return parsed.Host, options, nil
+}
 
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("error code: %d", resp.StatusCode)
-		}
-		return nil
+// getEndpointPool 相同 endpoint 的两端共用一个节点池和健康状态；
+// 一端单独设置了 ca_file/insecure 时 Transport 不同，按 side 单独建池
+func getEndpointPool(cctx *cli.Context, side string, endpoints []*url.URL, base *http.Transport) (*endpointPool, error) {
+	var hosts []string
+	for _, u := range endpoints {
+		hosts = append(hosts, u.String())
+	}
+	key := strings.Join(hosts, ",")
+	if remoteTLS[side] != nil {
+		key = side + "|" + key
 	}
 
-	declarePlayload := map[string]interface{}{
-		"jsonrpc": "2.0",
-		"method":  "Filecoin.StorageDeclareSector",
-		"params": []interface{}{
-			dstUuid,
-			map[string]interface{}{
-				"Miner":  mid,
-				"Number": snum,
-			},
-			1,
-			true,
-		},
-		"id": 1,
+	mutex.Lock()
+	defer mutex.Unlock()
+	if pool, ok := pools[key]; ok {
+		return pool, nil
 	}
-	err = request(declarePlayload)
+	pool, err := newEndpointPool(endpoints, cctx.String("lb"), cctx.Bool("dns_pool"), cctx.Duration("health_interval"), base)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Printf("declare %s in %s\n", object, dstUuid)
+	pools[key] = pool
+	return pool, nil
+}
 
-	dropPlayload := map[string]interface{}{
-		"jsonrpc": "2.0",
-		"method":  "Filecoin.StorageDropSector",
-		"params": []interface{}{
-			srcUuid,
-			map[string]interface{}{
-				"Miner":  mid,
-				"Number": snum,
-			},
-			1,
-		},
-		"id": 1,
+// 在目标位置声明扇区文件，在原位置删除声明
+func changeStorage(ctx context.Context, file sectorFile, srcUuid string, dstUuid string) error {
+	err := lotusApi.StorageDeclareSector(ctx, dstUuid, file.Sector, file.FileType, true)
+	if err != nil {
+		return err
 	}
-	err = request(dropPlayload)
+	log.Printf("declare %s in %s\n", file.Path, dstUuid)
+
+	err = lotusApi.StorageDropSector(ctx, srcUuid, file.Sector, file.FileType)
 	if err != nil {
 		return err
 	}
-	log.Printf("drop %s in %s\n", object, srcUuid)
+	log.Printf("drop %s in %s\n", file.Path, srcUuid)
 
 	return nil
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// listShard 一个列举分片：源 bucket 中的一个前缀，flat 为 true 时只包含这一层的对象，不包含子目录
+type listShard struct {
+	pair   bucketPair
+	prefix string
+	flat   bool
+}
+
+func (s listShard) id() string {
+	if s.flat {
+		return s.pair.src + "/" + s.prefix + "?flat"
+	}
+	return s.pair.src + "/" + s.prefix
+}
+
+// listObjects 并行列出 pairs 中每个源 bucket 下 prefix 的对象：先用 delimiter 列出 depth 层目录作为分片，
+// 途经各层目录下直接存放的对象各自作为一个 flat 分片，再由 listers 个 lister 并发列出各个分片。
+// listers 不大于 1 时整个 prefix 是一个分片。
+// cp 不为 nil 时从检查点的位置（StartAfter）继续列出，已完成的分片跳过
+// 列举出错时输出一个 Err 不为空的对象
+func listObjects(ctx context.Context, client *minio.Client, pairs []bucketPair, prefix string, listers, depth int, cp *listCheckpoint) <-chan migrateObject {
+	if listers <= 1 {
+		listers, depth = 1, 0
+	}
+	out := make(chan migrateObject)
+	go func() {
+		defer close(out)
+		shardCh := make(chan listShard)
+		var wg sync.WaitGroup
+		for i := 0; i < listers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for shard := range shardCh {
+					listShardObjects(ctx, client, shard, cp, out)
+				}
+			}()
+		}
+		for _, pair := range pairs {
+			err := discoverShards(ctx, client, listShard{pair: pair, prefix: prefix}, depth, shardCh)
+			if err != nil {
+				cp.fail()
+				out <- migrateObject{ObjectInfo: minio.ObjectInfo{Err: err}, bucket: pair}
+			}
+		}
+		close(shardCh)
+		wg.Wait()
+	}()
+	return out
+}
+
+// discoverShards 用 delimiter 逐层列出目录，第 depth 层的目录作为分片，途经的目录下有对象时加一个 flat 分片
+// 发现分片时需要完整列出途经的每一层，depth 不要超过直接存放大量文件的那一层
+func discoverShards(ctx context.Context, client *minio.Client, shard listShard, depth int, shardCh chan<- listShard) error {
+	if depth <= 0 {
+		shardCh <- shard
+		return nil
+	}
+	hasObjects := false
+	for obj := range client.ListObjects(ctx, shard.pair.src, minio.ListObjectsOptions{Prefix: shard.prefix}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if !strings.HasSuffix(obj.Key, "/") {
+			hasObjects = true
+			continue
+		}
+		if err := discoverShards(ctx, client, listShard{pair: shard.pair, prefix: obj.Key}, depth-1, shardCh); err != nil {
+			return err
+		}
+	}
+	if hasObjects {
+		shardCh <- listShard{pair: shard.pair, prefix: shard.prefix, flat: true}
+	}
+	return nil
+}
+
+func listShardObjects(ctx context.Context, client *minio.Client, shard listShard, cp *listCheckpoint, out chan<- migrateObject) {
+	id := shard.id()
+	startAfter, skip := cp.start(id)
+	if skip {
+		return
+	}
+	for obj := range client.ListObjects(ctx, shard.pair.src, minio.ListObjectsOptions{Prefix: shard.prefix, Recursive: !shard.flat, StartAfter: startAfter}) {
+		if obj.Err != nil {
+			cp.fail()
+			out <- migrateObject{ObjectInfo: obj, bucket: shard.pair}
+			return
+		}
+		// flat 分片中的子目录属于其它分片
+		if shard.flat && strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		out <- migrateObject{ObjectInfo: obj, bucket: shard.pair, done: cp.track(id, obj.Key)}
+	}
+	cp.listed(id)
+}
+
+// listCheckpoint 记录每个分片中已经处理完成的最后一个 key：该 key 及之前的对象都已迁移或已存在于目标，
+// 重新启动时从这个 key 之后继续列出。某个对象失败后该分片的检查点不再前进，下次运行会重新处理它
+type listCheckpoint struct {
+	name string
+
+	mu       sync.Mutex
+	state    checkpointState
+	progress map[string]*shardProgress
+	failed   bool
+}
+
+type checkpointState struct {
+	Shards map[string]string `json:"shards"`
+	Done   map[string]bool   `json:"done"`
+}
+
+type shardProgress struct {
+	// keys 已派发、还未确认完成的 key，按列出的顺序
+	keys    []string
+	done    map[string]bool
+	listed  bool
+	blocked bool
+}
+
+// loadListCheckpoint 读取检查点文件，文件不存在时从头开始
+func loadListCheckpoint(name string) (*listCheckpoint, error) {
+	c := &listCheckpoint{
+		name:     name,
+		state:    checkpointState{Shards: make(map[string]string), Done: make(map[string]bool)},
+		progress: make(map[string]*shardProgress),
+	}
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.state); err != nil {
+		return nil, err
+	}
+	if c.state.Shards == nil {
+		c.state.Shards = make(map[string]string)
+	}
+	if c.state.Done == nil {
+		c.state.Done = make(map[string]bool)
+	}
+	return c, nil
+}
+
+// start 返回分片的 StartAfter，分片已经完成时 skip 为 true
+func (c *listCheckpoint) start(id string) (startAfter string, skip bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state.Done[id] {
+		return "", true
+	}
+	c.progress[id] = &shardProgress{done: make(map[string]bool)}
+	return c.state.Shards[id], false
+}
+
+// track 记录派发的 key，返回对象处理完成时调用的函数，ok 为 false 表示处理失败
+func (c *listCheckpoint) track(id, key string) func(ok bool) {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	p := c.progress[id]
+	if !p.blocked {
+		p.keys = append(p.keys, key)
+	}
+	c.mu.Unlock()
+
+	return func(ok bool) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if p.blocked {
+			return
+		}
+		if !ok {
+			p.blocked, p.keys, p.done = true, nil, nil
+			return
+		}
+		p.done[key] = true
+		c.advance(id, p)
+	}
+}
+
+// listed 分片已经全部列出
+func (c *listCheckpoint) listed(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.progress[id]
+	p.listed = true
+	c.advance(id, p)
+}
+
+// fail 列举出错，结束时保留检查点文件
+func (c *listCheckpoint) fail() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.failed = true
+	c.mu.Unlock()
+}
+
+func (c *listCheckpoint) advance(id string, p *shardProgress) {
+	if p.blocked {
+		return
+	}
+	for len(p.keys) > 0 && p.done[p.keys[0]] {
+		delete(p.done, p.keys[0])
+		c.state.Shards[id] = p.keys[0]
+		p.keys = p.keys[1:]
+	}
+	if p.listed && len(p.keys) == 0 {
+		c.state.Done[id] = true
+		delete(c.state.Shards, id)
+	}
+}
+
+// save 先写临时文件再改名，中断时不会损坏检查点
+func (c *listCheckpoint) save() error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.name), "."+filepath.Base(c.name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.name)
+}
+
+// autosave 每隔 interval 保存一次，直到 stop 关闭
+func (c *listCheckpoint) autosave(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.save(); err != nil {
+				log.Println("save checkpoint error:", err)
+			}
+		}
+	}
+}
+
+// finish 全部分片都已完成时删除检查点文件，否则保存
+func (c *listCheckpoint) finish() error {
+	c.mu.Lock()
+	complete := !c.failed
+	for id := range c.progress {
+		if !c.state.Done[id] {
+			complete = false
+		}
+	}
+	c.mu.Unlock()
+	if complete {
+		err := os.Remove(c.name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return c.save()
+}
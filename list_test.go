@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// stubListServer 只实现 ListObjectsV2（prefix、delimiter、start-after）的 S3，bucket 中的 key 为 keys
+func stubListServer(t *testing.T, keys []string) *minio.Client {
+	t.Helper()
+	sort.Strings(keys)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("list-type") != "2" {
+			http.Error(w, "unsupported", http.StatusNotImplemented)
+			return
+		}
+		prefix, delimiter, startAfter := q.Get("prefix"), q.Get("delimiter"), q.Get("start-after")
+		type content struct {
+			Key          string
+			Size         int64
+			LastModified string
+		}
+		type commonPrefix struct {
+			Prefix string
+		}
+		result := struct {
+			XMLName        xml.Name `xml:"ListBucketResult"`
+			Name           string
+			Prefix         string
+			MaxKeys        int
+			IsTruncated    bool
+			Contents       []content
+			CommonPrefixes []commonPrefix
+		}{Name: "bkt", Prefix: prefix, MaxKeys: 1000}
+		seen := make(map[string]bool)
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) || key <= startAfter {
+				continue
+			}
+			if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+				}
+				continue
+			}
+			result.Contents = append(result.Contents, content{Key: key, Size: 1, LastModified: "2024-01-01T00:00:00.000Z"})
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4("ak", "sk", ""),
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func collectKeys(t *testing.T, ch <-chan migrateObject) []string {
+	t.Helper()
+	var keys []string
+	for obj := range ch {
+		if obj.Err != nil {
+			t.Fatal(obj.Err)
+		}
+		keys = append(keys, obj.Key)
+		if obj.done != nil {
+			obj.done(true)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var listTestKeys = []string{"a/1", "a/2", "a/x/1", "b/x/1", "b/x/2", "b/y/1", "top"}
+
+func TestListObjectsShards(t *testing.T) {
+	client := stubListServer(t, append([]string(nil), listTestKeys...))
+	pairs := []bucketPair{{src: "bkt", dst: "dst"}}
+	for depth := 0; depth <= 3; depth++ {
+		keys := collectKeys(t, listObjects(context.Background(), client, pairs, "", 3, depth, nil))
+		// 每个对象只出现一次，不会因为 flat 分片和子分片重叠而重复
+		if strings.Join(keys, ",") != strings.Join(listTestKeys, ",") {
+			t.Fatalf("depth %d: keys = %v", depth, keys)
+		}
+	}
+}
+
+func TestDiscoverShards(t *testing.T) {
+	client := stubListServer(t, append([]string(nil), listTestKeys...))
+	shardCh := make(chan listShard, 100)
+	pair := bucketPair{src: "bkt", dst: "dst"}
+	if err := discoverShards(context.Background(), client, listShard{pair: pair}, 2, shardCh); err != nil {
+		t.Fatal(err)
+	}
+	close(shardCh)
+	var ids []string
+	for shard := range shardCh {
+		ids = append(ids, shard.id())
+	}
+	sort.Strings(ids)
+	want := []string{"bkt/?flat", "bkt/a/?flat", "bkt/a/x/", "bkt/b/x/", "bkt/b/y/"}
+	if strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Fatalf("shards = %v, want %v", ids, want)
+	}
+}
+
+func TestListObjectsResume(t *testing.T) {
+	client := stubListServer(t, append([]string(nil), listTestKeys...))
+	name := filepath.Join(t.TempDir(), "ckpt")
+	cp, _ := loadListCheckpoint(name)
+	cp.state.Shards["bkt/a/"] = "a/1"
+	cp.state.Done["bkt/?flat"] = true
+	if err := cp.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := loadListCheckpoint(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := []bucketPair{{src: "bkt", dst: "dst"}}
+	keys := collectKeys(t, listObjects(context.Background(), client, pairs, "", 2, 1, cp))
+	// a/1 在检查点之前，top 所在的分片已完成
+	if want := "a/2,a/x/1,b/x/1,b/x/2,b/y/1"; strings.Join(keys, ",") != want {
+		t.Fatalf("keys = %v, want %s", keys, want)
+	}
+	if err := cp.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(name); len(matches) != 0 {
+		t.Fatal("checkpoint file not removed after resume completed")
+	}
+}
+
+func TestCheckpointOutOfOrder(t *testing.T) {
+	cp, _ := loadListCheckpoint(filepath.Join(t.TempDir(), "ckpt"))
+	if after, skip := cp.start("s"); after != "" || skip {
+		t.Fatalf("start = %q, %t", after, skip)
+	}
+	done1 := cp.track("s", "k1")
+	done2 := cp.track("s", "k2")
+	done3 := cp.track("s", "k3")
+
+	// k2 先完成，k1 还没完成，检查点不能前进
+	done2(true)
+	if got := cp.state.Shards["s"]; got != "" {
+		t.Fatalf("checkpoint = %q after k2, want empty", got)
+	}
+	done1(true)
+	if got := cp.state.Shards["s"]; got != "k2" {
+		t.Fatalf("checkpoint = %q after k1, want k2", got)
+	}
+	cp.listed("s")
+	if cp.state.Done["s"] {
+		t.Fatal("shard done before k3 completed")
+	}
+	done3(true)
+	if !cp.state.Done["s"] {
+		t.Fatal("shard not done after all keys completed")
+	}
+	if _, ok := cp.state.Shards["s"]; ok {
+		t.Fatal("done shard still has a checkpoint key")
+	}
+}
+
+func TestCheckpointFailureBlocksShard(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ckpt")
+	cp, _ := loadListCheckpoint(name)
+	cp.start("s")
+	done1 := cp.track("s", "k1")
+	done2 := cp.track("s", "k2")
+	done1(true)
+	done2(false)
+	done3 := cp.track("s", "k3")
+	done3(true)
+	cp.listed("s")
+	if got := cp.state.Shards["s"]; got != "k1" || cp.state.Done["s"] {
+		t.Fatalf("checkpoint = %q, done = %t, want k1 and not done", got, cp.state.Done["s"])
+	}
+
+	// 没有全部完成时 finish 保存检查点，下次从失败的 key 之前继续
+	if err := cp.finish(); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := loadListCheckpoint(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, skip := cp.start("s"); after != "k1" || skip {
+		t.Fatalf("start after reload = %q, %t, want k1", after, skip)
+	}
+}
+
+func TestCheckpointDoneSkippedOnReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ckpt")
+	cp, _ := loadListCheckpoint(name)
+	cp.start("a")
+	cp.track("a", "a/1")(true)
+	cp.listed("a")
+	cp.start("b")
+	cp.track("b", "b/1")(true)
+	cp.track("b", "b/2")
+	if err := cp.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := loadListCheckpoint(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, skip := cp.start("a"); !skip {
+		t.Fatal("done shard a not skipped")
+	}
+	if after, skip := cp.start("b"); after != "b/1" || skip {
+		t.Fatalf("shard b start = %q, %t, want b/1", after, skip)
+	}
+	// 全部完成后删除检查点文件
+	cp.track("b", "b/2")(true)
+	cp.listed("b")
+	if err := cp.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(name); len(matches) != 0 {
+		t.Fatal("checkpoint file not removed after completion")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// lotusClient 是 lotus-miner JSON-RPC 的最小客户端，只实现本工具用到的方法
+type lotusClient struct {
+	addr    string
+	token   string
+	client  *http.Client
+	retries int
+	nextID  int64
+}
+
+func newLotusClient(addr, token string, timeout time.Duration, retries int) *lotusClient {
+	return &lotusClient{
+		addr:    addr,
+		token:   token,
+		client:  &http.Client{Timeout: timeout},
+		retries: retries,
+	}
+}
+
+type rpcRequest struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      int64         `json:"id"`
+}
+
+type rpcResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	ID      int64           `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+}
+
+// rpcError 为 JSON-RPC 返回的错误，HTTP 状态码为 200 时也可能出现
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// sectorID 对应 lotus 的 abi.SectorID
+type sectorID struct {
+	Miner  uint64
+	Number uint64
+}
+
+// name 扇区文件名，与 lotus 一致，miner 地址在任何网络下都写成 t0 形式
+func (s sectorID) name() string {
+	return fmt.Sprintf("s-t0%d-%d", s.Miner, s.Number)
+}
+
+// call 调用 method 并把 result 解码到 result（可为 nil）
+// 网络错误和 5xx 会重试，JSON-RPC 返回的业务错误不重试
+func (c *lotusClient) call(ctx context.Context, method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("retry %s (%d/%d) after error: %s\n", method, attempt, c.retries, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+
+		var retry bool
+		retry, err = c.do(ctx, method, result, params)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *lotusClient) do(ctx context.Context, method string, result interface{}, params []interface{}) (bool, error) {
+	id := atomic.AddInt64(&c.nextID, 1)
+	payload, err := json.Marshal(rpcRequest{Jsonrpc: "2.0", Method: method, Params: params, ID: id})
+	if err != nil {
+		return false, fmt.Errorf("error encoding JSON: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.addr, bytes.NewReader(payload))
+	if err != nil {
+		return false, fmt.Errorf("error creating HTTP request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("error sending request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, fmt.Errorf("error reading response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500, fmt.Errorf("%s: error code: %d, body: %s", method, resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var rpcResp rpcResponse
+	if err := json.Unmarshal(body, &rpcResp); err != nil {
+		return false, fmt.Errorf("%s: error decoding response: %s", method, err)
+	}
+	if rpcResp.ID != id {
+		return false, fmt.Errorf("%s: response id %d does not match request id %d", method, rpcResp.ID, id)
+	}
+	if rpcResp.Error != nil {
+		return false, fmt.Errorf("%s: %w", method, rpcResp.Error)
+	}
+	if result != nil && len(rpcResp.Result) > 0 {
+		if err := json.Unmarshal(rpcResp.Result, result); err != nil {
+			return false, fmt.Errorf("%s: error decoding result: %s", method, err)
+		}
+	}
+	return false, nil
+}
+
+func (c *lotusClient) StorageDeclareSector(ctx context.Context, storageID string, sector sectorID, fileType int, primary bool) error {
+	return c.call(ctx, "Filecoin.StorageDeclareSector", nil, storageID, sector, fileType, primary)
+}
+
+func (c *lotusClient) StorageDropSector(ctx context.Context, storageID string, sector sectorID, fileType int) error {
+	return c.call(ctx, "Filecoin.StorageDropSector", nil, storageID, sector, fileType)
+}
+
+// storageDecl 对应 lotus 的 storiface.Decl
+type storageDecl struct {
+	Miner          uint64
+	Number         uint64
+	SectorFileType int
+}
+
+// StorageList 返回每个存储 ID 下声明的扇区文件
+func (c *lotusClient) StorageList(ctx context.Context) (map[string][]storageDecl, error) {
+	var out map[string][]storageDecl
+	err := c.call(ctx, "Filecoin.StorageList", &out)
+	return out, err
+}
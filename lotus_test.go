@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// stubLotus 模拟 lotus-miner 的 JSON-RPC 接口，handle 返回 result 或 rpcError
+func stubLotus(t *testing.T, handle func(req rpcRequest) (interface{}, *rpcError)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		var req rpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, rpcErr := handle(req)
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		if rpcErr != nil {
+			resp["error"] = rpcErr
+		} else {
+			resp["result"] = result
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLotusStorageDeclareSector(t *testing.T) {
+	var got rpcRequest
+	srv := stubLotus(t, func(req rpcRequest) (interface{}, *rpcError) {
+		got = req
+		return nil, nil
+	})
+	c := newLotusClient(srv.URL, "token", time.Second, 0)
+	if err := c.StorageDeclareSector(context.Background(), "uuid-1", sectorID{Miner: 1000, Number: 42}, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != "Filecoin.StorageDeclareSector" || got.Jsonrpc != "2.0" {
+		t.Fatalf("unexpected request: %+v", got)
+	}
+	params, _ := json.Marshal(got.Params)
+	if want := `["uuid-1",{"Miner":1000,"Number":42},2,true]`; string(params) != want {
+		t.Fatalf("params = %s, want %s", params, want)
+	}
+}
+
+func TestLotusStorageDropSector(t *testing.T) {
+	var got rpcRequest
+	srv := stubLotus(t, func(req rpcRequest) (interface{}, *rpcError) {
+		got = req
+		return nil, nil
+	})
+	c := newLotusClient(srv.URL, "token", time.Second, 0)
+	if err := c.StorageDropSector(context.Background(), "uuid-1", sectorID{Miner: 1000, Number: 42}, 4); err != nil {
+		t.Fatal(err)
+	}
+	params, _ := json.Marshal(got.Params)
+	if got.Method != "Filecoin.StorageDropSector" || string(params) != `["uuid-1",{"Miner":1000,"Number":42},4]` {
+		t.Fatalf("unexpected request: %s %s", got.Method, params)
+	}
+}
+
+func TestLotusStorageList(t *testing.T) {
+	srv := stubLotus(t, func(req rpcRequest) (interface{}, *rpcError) {
+		if req.Method != "Filecoin.StorageList" || len(req.Params) != 0 {
+			t.Errorf("unexpected request: %+v", req)
+		}
+		return map[string][]storageDecl{
+			"uuid-1": {{Miner: 1000, Number: 1, SectorFileType: 2}, {Miner: 1000, Number: 2, SectorFileType: 4}},
+		}, nil
+	})
+	c := newLotusClient(srv.URL, "token", time.Second, 0)
+	list, err := c.StorageList(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decls := list["uuid-1"]
+	if len(list) != 1 || len(decls) != 2 || decls[1] != (storageDecl{Miner: 1000, Number: 2, SectorFileType: 4}) {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+}
+
+func TestLotusRPCError(t *testing.T) {
+	var calls int32
+	srv := stubLotus(t, func(req rpcRequest) (interface{}, *rpcError) {
+		atomic.AddInt32(&calls, 1)
+		return nil, &rpcError{Code: 1, Message: "storage not found"}
+	})
+	c := newLotusClient(srv.URL, "token", time.Second, 2)
+	err := c.StorageDropSector(context.Background(), "uuid-1", sectorID{Miner: 1000, Number: 42}, 4)
+	var rpcErr *rpcError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != 1 || rpcErr.Message != "storage not found" {
+		t.Fatalf("err = %v, want rpc error", err)
+	}
+	// 业务错误不重试
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+}
+
+func TestLotusRetry5xx(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		var req rpcRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": nil})
+	}))
+	defer srv.Close()
+
+	c := newLotusClient(srv.URL, "token", time.Second, 1)
+	if err := c.StorageDeclareSector(context.Background(), "uuid-1", sectorID{Miner: 1000, Number: 42}, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("calls = %d, want 2", calls)
+	}
+}
+
+func TestLotusNo4xxRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	c := newLotusClient(srv.URL, "token", time.Second, 2)
+	err := c.StorageDeclareSector(context.Background(), "uuid-1", sectorID{Miner: 1000, Number: 42}, 2, true)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("err = %v, want 401", err)
+	}
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+}
+
+func TestLotusRetryNetworkError(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// 不返回响应直接断开连接
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		var req rpcRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": map[string][]storageDecl{}})
+	}))
+	defer srv.Close()
+
+	c := newLotusClient(srv.URL, "token", time.Second, 1)
+	if _, err := c.StorageList(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("calls = %d, want 2", calls)
+	}
+}
+
+func TestLotusTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	c := newLotusClient(srv.URL, "token", 100*time.Millisecond, 0)
+	start := time.Now()
+	err := c.StorageDeclareSector(context.Background(), "uuid-1", sectorID{Miner: 1000, Number: 42}, 2, true)
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("call took %s, timeout not applied", elapsed)
+	}
+}
+
+func TestSectorName(t *testing.T) {
+	// lotus 的扇区文件名总是 t0 形式，与 --miner 写成 f01000 还是 t01000 无关
+	for _, miner := range []string{"f01000", "t01000"} {
+		addr, err := address.NewFromString(miner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := address.IDFromAddress(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := (sectorID{Miner: id, Number: 5}).name(); got != "s-t01000-5" {
+			t.Errorf("%s: name = %s, want s-t01000-5", miner, got)
+		}
+	}
+}
@@ -3,25 +3,65 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
 
+// errorExitCode 命令出错时的退出码，diff 用 1 表示有差异，出错时为 2
+var errorExitCode = 1
+
 func main() {
 	app := &cli.App{
 		Name:    "s3-tools",
 		Usage:   "s3 tools",
 		Version: UserVersion(),
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				EnvVars: []string{"config"},
+				Usage:   "config file with remotes and jobs, default ~/.s3-tools.yaml",
+			},
+			&cli.BoolFlag{
+				Name:    "random_ip",
+				EnvVars: []string{"random_ip"},
+				Usage:   "connect to a random address the endpoint domain resolves to (IPv4 or IPv6) for each new connection",
+			},
+			&cli.StringFlag{
+				Name:    "lb",
+				EnvVars: []string{"lb"},
+				Value:   "round-robin",
+				Usage:   "load balancing of endpoint pools: round-robin, least-conn",
+			},
+			&cli.BoolFlag{
+				Name:    "dns_pool",
+				EnvVars: []string{"dns_pool"},
+				Usage:   "use all addresses the endpoint domain resolves to as an endpoint pool",
+			},
+			&cli.DurationFlag{
+				Name:    "health_interval",
+				EnvVars: []string{"health_interval"},
+				Value:   10 * time.Second,
+				Usage:   "interval of active health checks of endpoint pools, 0 to disable",
+			},
+		},
 		Commands: []*cli.Command{
 			migrate,
+			migrateSectors,
+			checkIndex,
 			download,
 			upload,
+			export,
+			inventory,
+			diff,
+			cp,
+			run,
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		fmt.Printf("ERROR: %+v\n", err)
-		os.Exit(1)
+		os.Exit(errorExitCode)
 		return
 	}
 }
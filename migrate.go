@@ -3,100 +3,38 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
-	"net/url"
-	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/urfave/cli/v2"
 )
 
 var migrate = &cli.Command{
 	Name:  "migrate",
 	Usage: "s3 to s3 migrate",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
-			Name:     "src_endpoint",
-			EnvVars:  []string{"src_endpoint"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "src_ak",
-			EnvVars:  []string{"src_ak"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "src_sk",
-			EnvVars:  []string{"src_sk"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "src_bucket",
-			EnvVars:  []string{"src_bucket"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "src_region",
-			EnvVars:  []string{"src_region"},
-			Required: false,
-			Hidden:   true,
-		},
-		&cli.StringFlag{
-			Name:    "src_prefix",
-			EnvVars: []string{"src_prefix"},
-		},
-		&cli.StringFlag{
-			Name:    "src_bucket_lookup",
-			EnvVars: []string{"src_bucket_lookup"},
-			Value:   "auto",
-			Usage:   "bucket lookup type: dns, path, auto",
-		},
-		&cli.StringFlag{
-			Name:     "dst_endpoint",
-			EnvVars:  []string{"dst_endpoint"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_ak",
-			EnvVars:  []string{"dst_ak"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_sk",
-			EnvVars:  []string{"dst_sk"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_bucket",
-			EnvVars:  []string{"dst_bucket"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_region",
-			EnvVars:  []string{"dst_region"},
-			Required: false,
-			Hidden:   true,
-		},
-		&cli.StringFlag{
-			Name:    "dst_prefix",
-			EnvVars: []string{"dst_prefix"},
+			Name:    "filelist",
+			EnvVars: []string{"filelist"},
+			Usage:   "specify the list to be migrated, one object per line. - reads stdin, s3://bucket/key reads from the src endpoint",
 		},
 		&cli.StringFlag{
-			Name:    "dst_bucket_lookup",
-			EnvVars: []string{"dst_bucket_lookup"},
+			Name:    "filelist_format",
+			EnvVars: []string{"filelist_format"},
 			Value:   "auto",
-			Usage:   "bucket lookup type: dns, path, auto",
+			Usage:   "filelist format: plain, csv, jsonl, auto (by file extension)",
 		},
 		&cli.StringFlag{
-			Name:    "filelist",
-			EnvVars: []string{"filelist"},
-			Usage:   "specify the list to be migrated, one object per line",
+			Name:    "failed_list",
+			EnvVars: []string{"failed_list"},
+			Usage:   "write the entries that failed checksum or size verification to this file, in jsonl format",
 		},
 		&cli.StringFlag{
 			Name:    "PartSize",
@@ -129,16 +67,98 @@ var migrate = &cli.Command{
 			EnvVars: []string{"concurrent"},
 			Value:   10,
 		},
+		&cli.StringFlag{
+			Name:    "schedule",
+			EnvVars: []string{"schedule"},
+			Value:   scheduleFIFO,
+			Usage:   "order of the objects dispatched to the workers: fifo (listing order), smallest, largest, oldest (LastModified) or priority (priority of the filelist)",
+		},
+		&cli.IntFlag{
+			Name:    "schedule_window",
+			EnvVars: []string{"schedule_window"},
+			Value:   10000,
+			Usage:   "number of listed objects buffered and ordered by schedule",
+		},
+		&cli.IntFlag{
+			Name:    "small_workers",
+			EnvVars: []string{"small_workers"},
+			Usage:   "workers of concurrent reserved for objects not larger than small_size",
+		},
+		&cli.StringFlag{
+			Name:    "small_size",
+			EnvVars: []string{"small_size"},
+			Value:   "64MiB",
+			Usage:   "max size of the objects handled by small_workers",
+		},
 		&cli.BoolFlag{
 			Name:    "watch",
 			EnvVars: []string{"watch"},
 			Usage:   "loop to check if there is new data",
 		},
+		&cli.StringFlag{
+			Name:    "dedup_dir",
+			EnvVars: []string{"dedup_dir"},
+			Usage:   "keep the keys dispatched by watch in this directory instead of memory, memory stays bounded with millions of keys and the state survives restarts",
+		},
 		&cli.BoolFlag{
 			Name:    "remove",
 			EnvVars: []string{"remove"},
 			Usage:   "delete after completion",
 		},
+		&cli.IntFlag{
+			Name:    "listers",
+			EnvVars: []string{"listers"},
+			Value:   1,
+			Usage:   "list the src with this many goroutines, the prefixes found list_depth levels below src_prefix are listed in parallel",
+		},
+		&cli.IntFlag{
+			Name:    "list_depth",
+			EnvVars: []string{"list_depth"},
+			Value:   1,
+			Usage:   "levels of the prefixes used as listing shards",
+		},
+		&cli.StringFlag{
+			Name:    "list_checkpoint",
+			EnvVars: []string{"list_checkpoint"},
+			Usage:   "save listing progress to this file and continue from it when restarted, removed when everything is migrated",
+		},
+		&cli.StringFlag{
+			Name:    "src_buckets",
+			EnvVars: []string{"src_buckets"},
+			Usage:   "migrate every src bucket matching the globs instead of src_bucket, separated by comma, e.g. * or sector-*",
+		},
+		&cli.StringFlag{
+			Name:    "bucket_map",
+			EnvVars: []string{"bucket_map"},
+			Usage:   "dst bucket of the src buckets, src=dst separated by comma, default the same name",
+		},
+		&cli.StringFlag{
+			Name:    "report",
+			EnvVars: []string{"report"},
+			Usage:   "write the per bucket result (json) to this file",
+		},
+		&cli.BoolFlag{
+			Name:    "create_bucket",
+			EnvVars: []string{"create_bucket"},
+			Usage:   "create dst bucket in dst_region if it does not exist, with object lock enabled if the src bucket has it",
+		},
+		&cli.StringFlag{
+			Name:    "bucket_config",
+			EnvVars: []string{"bucket_config"},
+			Usage:   "copy bucket configs from src to dst before migrating objects, separated by comma: all, policy, lifecycle, versioning, encryption, cors, notification, tags",
+		},
+		&cli.BoolFlag{
+			Name:    "all_versions",
+			Aliases: []string{"all-versions"},
+			EnvVars: []string{"all_versions"},
+			Usage:   "replay all versions and delete markers of the src in chronological order, dst bucket must have versioning enabled",
+		},
+		&cli.StringFlag{
+			Name:    "version_id",
+			Aliases: []string{"version-id"},
+			EnvVars: []string{"version_id"},
+			Usage:   "only migrate this version of the objects, overwrite the dst object",
+		},
 		&cli.StringFlag{
 			Name:    "src_uuid",
 			EnvVars: []string{"src_uuid"},
@@ -159,20 +179,34 @@ var migrate = &cli.Command{
 			EnvVars: []string{"token"},
 			Usage:   "miner admin token",
 		},
-	},
+		&cli.DurationFlag{
+			Name:    "rpc_timeout",
+			EnvVars: []string{"rpc_timeout"},
+			Value:   30 * time.Second,
+			Usage:   "timeout of each miner rpc request",
+		},
+		&cli.IntFlag{
+			Name:    "rpc_retries",
+			EnvVars: []string{"rpc_retries"},
+			Value:   3,
+			Usage:   "retries of miner rpc requests on network errors and 5xx responses",
+		},
+		&cli.StringFlag{
+			Name:    "compress",
+			EnvVars: []string{"compress"},
+			Usage:   "compress objects whose key matches the pattern before sending, pattern=codec separated by comma, codec: zstd, gzip, e.g. *.log=zstd,*.json=gzip",
+		},
+	}, append(append(append(append(endpointFlags("src", "dst"), bucketFlags("src", "dst")...), credentialFlags("src", "dst")...), sseFlags("src", "dst")...), cseFlags("src", "dst")...)...),
 	UsageText: `
 src_endpoint and dst_endpoint must use type scheme://domain[:port], example http://example.com[:80]
 `,
+	Before: remoteBefore("src", "dst"),
 	Action: migrateAction,
 }
 
 func migrateAction(cctx *cli.Context) error {
 
-	src_bucket := cctx.String("src_bucket")
-	src_region := cctx.String("src_region")
 	src_prefix := cctx.String("src_prefix")
-	dst_bucket := cctx.String("dst_bucket")
-	dst_region := cctx.String("dst_region")
 	dst_prefix := cctx.String("dst_prefix")
 
 	PartSize, err := humanize.ParseBytes(cctx.String("PartSize"))
@@ -183,138 +217,203 @@ func migrateAction(cctx *cli.Context) error {
 	ConcurrentStreamParts := cctx.Bool("EnableMemCache")
 	DisableMultipart := cctx.Bool("DisableMultipart")
 	DisableContentSha256 := cctx.Bool("DisableContentSha256")
-	disableLookupDomain = cctx.Bool("disable_lookup")
+	compressRules, err := parseCompressRules(cctx.String("compress"))
+	if err != nil {
+		return err
+	}
 	remove := cctx.Bool("remove")
 
 	if cctx.IsSet("src_uuid") || cctx.IsSet("dst_uuid") || cctx.IsSet("rpc") || cctx.IsSet("token") {
 		srcUuid = cctx.String("src_uuid")
 		dstUuid = cctx.String("dst_uuid")
-		rpc = cctx.String("rpc")
-		token = cctx.String("token")
+		rpc := cctx.String("rpc")
+		token := cctx.String("token")
 		if srcUuid == "" || dstUuid == "" || rpc == "" || token == "" {
 			return fmt.Errorf("must srcUuid,dstUuid,rpc,token all set")
 		}
+		lotusApi = newLotusClient(rpc, token, cctx.Duration("rpc_timeout"), cctx.Int("rpc_retries"))
 	}
 
 	// url parse
-	parsedSrc, err := url.Parse(cctx.String("src_endpoint"))
+	src_endpoint, srcOptions, err := newS3Options(cctx, "src")
 	if err != nil {
 		return err
 	}
-	src_endpoint := parsedSrc.Host
-	src_ssl := parsedSrc.Scheme == "https"
-	srcOptions := &minio.Options{
-		Creds:     credentials.NewStaticV4(cctx.String("src_ak"), cctx.String("src_sk"), ""),
-		Secure:    src_ssl,
-		Region:    src_region,
-		Transport: transport,
+
+	dst_endpoint, dstOptions, err := newS3Options(cctx, "dst")
+	if err != nil {
+		return err
 	}
 
-	// Set bucket lookup type based on the flag
-	bucketLookup := cctx.String("src_bucket_lookup")
-	switch bucketLookup {
-	case "dns":
-		srcOptions.BucketLookup = minio.BucketLookupDNS
-	case "path":
-		srcOptions.BucketLookup = minio.BucketLookupPath
-	case "auto":
-		srcOptions.BucketLookup = minio.BucketLookupAuto
-	default:
-		return fmt.Errorf("invalid bucket_lookup value: %s, must be one of: dns, path, auto", bucketLookup)
+	// 先检查全部参数，参数有误时不会修改目标
+	if cctx.String("src_buckets") != "" && cctx.IsSet("filelist") {
+		return fmt.Errorf("only be specified src_buckets or filelist")
+	}
+	if cctx.String("list_checkpoint") != "" && (cctx.Bool("watch") || cctx.IsSet("filelist")) {
+		return fmt.Errorf("list_checkpoint cannot be used with watch or filelist")
+	}
+	versions := cctx.Bool("all_versions") || cctx.String("version_id") != ""
+	if versions {
+		if cctx.Bool("all_versions") && cctx.String("version_id") != "" {
+			return fmt.Errorf("only be specified all_versions or version_id")
+		}
+		if cctx.Bool("watch") || cctx.IsSet("filelist") || remove || srcUuid != "" || cctx.String("src_buckets") != "" {
+			return fmt.Errorf("all_versions and version_id cannot be used with watch, filelist, remove, src_buckets or the sector index options")
+		}
+	}
+	if cctx.String("dedup_dir") != "" && !cctx.Bool("watch") {
+		return fmt.Errorf("dedup_dir requires watch")
+	}
+	configs, err := parseBucketConfigs(cctx.String("bucket_config"))
+	if err != nil {
+		return err
+	}
+	smallSize, err := humanize.ParseBytes(cctx.String("small_size"))
+	if err != nil {
+		return fmt.Errorf("invalid small_size: %w", err)
+	}
+	sched, err := newScheduler(cctx.String("schedule"), cctx.Int("schedule_window"), cctx.Int("concurrent"), cctx.Int("small_workers"), int64(smallSize))
+	if err != nil {
+		return err
+	}
+	var checkpoint *listCheckpoint
+	if cctx.String("list_checkpoint") != "" {
+		if checkpoint, err = loadListCheckpoint(cctx.String("list_checkpoint")); err != nil {
+			return err
+		}
 	}
 
-	parsedDst, err := url.Parse(cctx.String("dst_endpoint"))
+	ctx := context.Background()
+
+	s3SrcClient, err := minio.New(src_endpoint, srcOptions)
+	if err != nil {
+		return err
+	}
+	pairs, err := migrateBucketPairs(ctx, cctx, s3SrcClient)
 	if err != nil {
 		return err
 	}
-	dst_endpoint := parsedDst.Host
-	dst_ssl := parsedDst.Scheme == "https"
-	dstOptions := &minio.Options{
-		Creds:     credentials.NewStaticV4(cctx.String("dst_ak"), cctx.String("dst_sk"), ""),
-		Secure:    dst_ssl,
-		Region:    dst_region,
-		Transport: transport,
+	if cctx.Bool("create_bucket") || len(configs) > 0 {
+		dst, err := minio.New(dst_endpoint, dstOptions)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			if cctx.Bool("create_bucket") {
+				if err := createBucket(ctx, s3SrcClient, pair.src, dst, pair.dst, cctx.String("dst_region")); err != nil {
+					return err
+				}
+			}
+			if err := copyBucketConfigs(ctx, s3SrcClient, pair.src, srcOptions, dst, pair.dst, dstOptions, configs); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Set bucket lookup type based on the flag
-	bucketLookup = cctx.String("dst_bucket_lookup")
-	switch bucketLookup {
-	case "dns":
-		dstOptions.BucketLookup = minio.BucketLookupDNS
-	case "path":
-		dstOptions.BucketLookup = minio.BucketLookupPath
-	case "auto":
-		dstOptions.BucketLookup = minio.BucketLookupAuto
-	default:
-		return fmt.Errorf("invalid bucket_lookup value: %s, must be one of: dns, path, auto", bucketLookup)
+	if versions {
+		dst, err := minio.New(dst_endpoint, dstOptions)
+		if err != nil {
+			return err
+		}
+		putOptions := minio.PutObjectOptions{ServerSideEncryption: dstSSE, NumThreads: NumThreads, PartSize: PartSize, ConcurrentStreamParts: ConcurrentStreamParts, DisableMultipart: DisableMultipart, DisableContentSha256: DisableContentSha256}
+		return migrateVersions(ctx, cctx, s3SrcClient, dst, putOptions, compressRules)
 	}
 
-	ctx := context.Background()
+	// watch 模式下 48 小时内已经派发的任务不会重复派发
+	var alreadyJobs jobDedup = newMemDedup(48 * time.Hour)
+	if cctx.String("dedup_dir") != "" {
+		if alreadyJobs, err = openDiskDedup(cctx.String("dedup_dir"), 48*time.Hour); err != nil {
+			return fmt.Errorf("open dedup_dir: %w", err)
+		}
+	}
 
-	objectsCh := make(chan minio.ObjectInfo)
+	objectsCh := make(chan migrateObject)
 	go func() {
 		defer close(objectsCh)
-		alreadyJobs := make(map[string]time.Time)
 		for {
 			if cctx.IsSet("filelist") {
-				content, err := os.ReadFile(cctx.String("filelist"))
+				err := readFilelist(ctx, s3SrcClient, cctx.String("filelist"), cctx.String("filelist_format"), false, func(entry fileEntry) error {
+					objectsCh <- migrateObject{ObjectInfo: minio.ObjectInfo{Key: entry.Source}, bucket: pairs[0], entry: &entry}
+					return nil
+				})
 				if err != nil {
 					log.Fatal(err)
 				}
-				lines := strings.Split(strings.TrimSpace(string(content)), "\n")
-				for _, key := range lines {
-					objectsCh <- minio.ObjectInfo{Key: key}
-				}
 				return
 			}
 
-			s3SrcClient, err := minio.New(src_endpoint, srcOptions)
-			if err != nil {
-				log.Fatal(err)
-				return
-			}
 			// 每60分钟列出object，48小时内已经派发的任务不会重复派，48小时之前已经派发的任务还会重新派（如果文件已经在目标位置存在不会重新传输）
-			tmpCh := s3SrcClient.ListObjects(ctx, src_bucket, minio.ListObjectsOptions{
-				Prefix:    src_prefix,
-				Recursive: true,
-			})
+			// 多个 bucket 共用同一个 worker 池，可以按前缀分片并行列出
+			tmpCh := listObjects(ctx, s3SrcClient, pairs, src_prefix, cctx.Int("listers"), cctx.Int("list_depth"), checkpoint)
 			for obj := range tmpCh {
-				if _, ok := alreadyJobs[obj.Key]; ok {
-					continue
+				job := obj.bucket.src + "/" + obj.Key
+				if obj.Err == nil {
+					seen, err := alreadyJobs.seen(job)
+					if err != nil {
+						log.Fatal("read dedup state error: ", err)
+					}
+					if seen {
+						continue
+					}
 				}
 				objectsCh <- obj
-				alreadyJobs[obj.Key] = time.Now()
+				if err := alreadyJobs.add(job); err != nil {
+					log.Fatal("write dedup state error: ", err)
+				}
 			}
 			if !cctx.Bool("watch") {
 				return
 			}
+			// 每轮结束后就合并，下次启动时不会重复派发这一轮的任务
+			if err := alreadyJobs.expire(); err != nil {
+				log.Fatal("save dedup state error: ", err)
+			}
 			time.Sleep(60 * time.Minute)
-
-			deleteOldEntries(alreadyJobs, 48)
 		}
 
 	}()
 
 	// A wait group to manage the number of active goroutines.
 	var wg sync.WaitGroup
-	// Create a buffered channel to manage the number of workers.
-	workerCh := make(chan struct{}, cctx.Int("concurrent"))
+	var failed failedEntries
+	var report migrateReport
+	if checkpoint != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go checkpoint.autosave(10*time.Second, stop)
+	}
 
-	for object := range objectsCh {
+	// scheduler 按 schedule 的顺序派发对象，并限制 worker 的数量
+	go sched.feed(objectsCh)
+	for {
+		object, release, ok := sched.next()
+		if !ok {
+			break
+		}
 		if object.Err != nil {
 			log.Println("ListObjects error:", object.Err)
+			release()
 			continue
 		}
 
 		// Start a new worker.
 		wg.Add(1)
-		workerCh <- struct{}{} // Add to the worker queue.
-		go func(object minio.ObjectInfo) {
+		go func(object migrateObject) {
 			defer wg.Done()
+			defer release()
+			status := "failed"
 			defer func() {
-				<-workerCh // Remove from the worker queue.
+				report.add(object.bucket, status, object.Size)
+				if object.done != nil {
+					object.done(status != "failed")
+				}
 			}()
 
+			dstKey := path.Join(dst_prefix, object.Key)
+			if object.entry != nil && object.entry.Dest != "" {
+				dstKey = path.Join(dst_prefix, object.entry.Dest)
+			}
+
 			src, err := minio.New(src_endpoint, srcOptions)
 			if err != nil {
 				log.Println(err)
@@ -328,18 +427,19 @@ func migrateAction(cctx *cli.Context) error {
 			}
 
 			// Check if object already exists in the destination bucket.
-			log.Printf("start StatObject %s in bucket %s\n", path.Join(dst_prefix, object.Key), dst_bucket)
-			_, err = dst.StatObject(ctx, dst_bucket, path.Join(dst_prefix, object.Key), minio.StatObjectOptions{})
+			log.Printf("start StatObject %s in bucket %s\n", dstKey, object.bucket.dst)
+			_, err = dst.StatObject(ctx, object.bucket.dst, dstKey, minio.StatObjectOptions{ServerSideEncryption: dstSSE})
 			if err == nil {
-				log.Printf("object %s already exists in destination bucket %s\n", object.Key, dst_bucket)
+				log.Printf("object %s already exists in destination bucket %s\n", object.Key, object.bucket.dst)
+				status = "skipped"
 				return
 			} else if !strings.Contains(err.Error(), "The specified key does not exist.") {
 				log.Println("StatObject error:", err)
 				return
 			}
 
-			log.Printf("start GetObject %s in bucket %s\n", object.Key, src_bucket)
-			reader, err := src.GetObject(ctx, src_bucket, object.Key, minio.GetObjectOptions{})
+			log.Printf("start GetObject %s in bucket %s\n", object.Key, object.bucket.src)
+			reader, err := src.GetObject(ctx, object.bucket.src, object.Key, minio.GetObjectOptions{ServerSideEncryption: srcSSE})
 			if err != nil {
 				log.Println("GetObject error:", err)
 				return
@@ -351,25 +451,91 @@ func migrateAction(cctx *cli.Context) error {
 				log.Println("Stat error:", err)
 				return
 			}
-			object.Size = info.Size
+			// size / checksum 都是解密、解压后原始内容的
+			decoded, size, err := decodeObject(reader, info)
+			if err != nil {
+				log.Printf("decode %s failed: %s\n", object.Key, err)
+				return
+			}
+			defer decoded.Close()
+			var body io.Reader = decoded
+			object.Size = size
+
+			// 文件列表中指定了 size / checksum 时，边传输边校验
+			entry := fileEntry{Size: -1}
+			if object.entry != nil {
+				entry = *object.entry
+			}
+			if entry.Size >= 0 && object.Size >= 0 && object.Size != entry.Size {
+				log.Printf("verify %s failed: size mismatch: expected %d, got %d\n", object.Key, entry.Size, object.Size)
+				failed.add(entry)
+				return
+			}
+			// 大小已知时已在上面检查过，这里只需要校验 checksum
+			verifier := newVerifyWriter(entry.digest, -1)
+			if object.Size < 0 {
+				verifier = newVerifyWriter(entry.digest, entry.Size)
+			}
+			if entry.digest != nil || object.Size < 0 {
+				body = io.TeeReader(body, verifier)
+			}
+			encoded, size, metadata, err := encodeObject(body, object.Size, dstKey, compressRules, entry.Metadata)
+			if err != nil {
+				log.Printf("encode %s failed: %s\n", object.Key, err)
+				return
+			}
+			defer encoded.Close()
+			body = encoded
 
-			log.Printf("start upload %s to bucket %s\n", path.Join(dst_prefix, object.Key), dst_bucket)
-			_, err = dst.PutObject(ctx, dst_bucket, path.Join(dst_prefix, object.Key), reader, object.Size, minio.PutObjectOptions{NumThreads: NumThreads, PartSize: PartSize, ConcurrentStreamParts: ConcurrentStreamParts, DisableMultipart: DisableMultipart, DisableContentSha256: DisableContentSha256})
+			// 压缩后大小未知，minio-go 要求使用分片上传
+			log.Printf("start upload %s to bucket %s\n", dstKey, object.bucket.dst)
+			_, err = dst.PutObject(ctx, object.bucket.dst, dstKey, body, size, minio.PutObjectOptions{ServerSideEncryption: dstSSE, UserMetadata: metadata, UserTags: entry.Tags, NumThreads: NumThreads, PartSize: PartSize, ConcurrentStreamParts: ConcurrentStreamParts, DisableMultipart: DisableMultipart && size >= 0, DisableContentSha256: DisableContentSha256})
 			if err != nil {
 				log.Println("PutObject error:", err)
 				return
 			}
-			log.Printf("object %s copied to destination bucket %s\n", object.Key, dst_bucket)
+			if err := verifier.Verify(); err != nil {
+				log.Printf("verify %s failed: %s\n", object.Key, err)
+				failed.add(entry)
+				err = dst.RemoveObject(ctx, object.bucket.dst, dstKey, minio.RemoveObjectOptions{})
+				if err != nil {
+					log.Println("RemoveObject error:", err)
+				}
+				return
+			}
+			log.Printf("object %s copied to destination bucket %s\n", object.Key, object.bucket.dst)
+			status = "copied"
 
 			if srcUuid != "" {
-				err := changeStorage(object.Key, srcUuid, dstUuid)
+				file, err := parseSectorKey(object.Key)
 				if err != nil {
 					log.Println("changeStorage error:", err)
 					return
 				}
+				// cache 目录包含多个文件，全部迁移完成后才重新声明，且只声明一次
+				declare := true
+				if file.isDir() {
+					declare, err = sectorDirMigrated(ctx, src, object.bucket.src, file.Path, dst, object.bucket.dst, dst_prefix)
+					if err != nil {
+						log.Println("changeStorage error:", err)
+						return
+					}
+					if !declare {
+						log.Printf("wait for the remaining files of %s before changeStorage\n", file.Path)
+					} else {
+						declare = claimSectorDir(file.Path)
+					}
+				}
+				if declare {
+					err = changeStorage(ctx, file, srcUuid, dstUuid)
+					if err != nil {
+						log.Println("changeStorage error:", err)
+						return
+					}
+				}
 			}
 			if remove {
-				err = src.RemoveObject(ctx, src_bucket, object.Key, minio.RemoveObjectOptions{})
+				err = src.RemoveObject(ctx, object.bucket.src, object.Key, minio.RemoveObjectOptions{})
 				if err != nil {
 					log.Println("RemoveObject error:", err)
 					return
@@ -382,5 +548,83 @@ func migrateAction(cctx *cli.Context) error {
 
 	// Wait for all workers to finish.
 	wg.Wait()
-	return nil
+	if checkpoint != nil {
+		if err := checkpoint.finish(); err != nil {
+			return err
+		}
+	}
+	if err := report.finish(cctx.String("report")); err != nil {
+		return err
+	}
+	return failed.finish(cctx.String("failed_list"))
+}
+
+// migrateObject 待迁移的对象，bucket 为对象所在的源和对应的目标 bucket，来自文件列表时 entry 不为空
+// done 不为空时在对象处理结束后调用，用于推进列举检查点
+type migrateObject struct {
+	minio.ObjectInfo
+	bucket bucketPair
+	entry  *fileEntry
+	done   func(ok bool)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decodeObject 按对象的 metadata 解密（源端客户端加密）、解压，返回原始内容和大小，大小为 -1 表示未知
+func decodeObject(r io.Reader, info minio.ObjectInfo) (io.ReadCloser, int64, error) {
+	size := csePlainSize(srcCSE, info.Size)
+	if srcCSE != nil {
+		var err error
+		r, err = srcCSE.decrypt(r, info.Metadata)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	s, compressed := uncompressedSize(info.Metadata)
+	if !compressed {
+		return io.NopCloser(r), size, nil
+	}
+	decompressed, err := decompressReader(r, info.Metadata)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decompressed, s, nil
+}
+
+// plainSize 对象原始内容的大小：压缩过的对象取 metadata 中记录的原始大小，客户端加密的对象取加密前的大小，
+// 没有 metadata（如列举结果）时按 k 推算，-1 表示未知
+func plainSize(info minio.ObjectInfo, k *cseKey) int64 {
+	if s, compressed := uncompressedSize(info.Metadata); compressed {
+		return s
+	}
+	if v := info.Metadata.Get("X-Amz-Meta-" + cseMetaSize); v != "" {
+		if s, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return s
+		}
+	}
+	return csePlainSize(k, info.Size)
+}
+
+// encodeObject 按 compress 规则压缩、按目标端客户端加密设置加密写入的内容，返回写入的大小和合并后的 metadata
+func encodeObject(r io.Reader, size int64, key string, rules []compressRule, metadata map[string]string) (io.ReadCloser, int64, map[string]string, error) {
+	var closer io.Closer = io.NopCloser(nil)
+	if codec := matchCompress(rules, key); codec != "" {
+		compressed, compressedMeta, err := compressReader(r, codec, size, metadata)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		r, size, metadata, closer = compressed, -1, compressedMeta, compressed
+	}
+	if dstCSE != nil {
+		encrypted, encryptedSize, encryptedMeta, err := dstCSE.encrypt(r, size, metadata)
+		if err != nil {
+			closer.Close()
+			return nil, 0, nil, err
+		}
+		r, size, metadata = encrypted, encryptedSize, encryptedMeta
+	}
+	return readCloser{Reader: r, Closer: closer}, size, metadata, nil
 }
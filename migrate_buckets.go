@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/urfave/cli/v2"
+)
+
+// bucketPair 一对源和目标 bucket
+type bucketPair struct {
+	src string
+	dst string
+}
+
+// migrateBucketPairs 返回要迁移的 bucket，没有设置 src_buckets 时只有 src_bucket -> dst_bucket，
+// 否则列出源的全部 bucket，按 src_buckets 中的 glob 过滤，目标 bucket 同名或按 bucket_map 映射
+func migrateBucketPairs(ctx context.Context, cctx *cli.Context, src *minio.Client) ([]bucketPair, error) {
+	if cctx.String("src_buckets") == "" {
+		if cctx.IsSet("bucket_map") {
+			return nil, fmt.Errorf("bucket_map requires src_buckets")
+		}
+		return []bucketPair{{src: cctx.String("src_bucket"), dst: cctx.String("dst_bucket")}}, nil
+	}
+
+	var patterns []string
+	for _, pattern := range strings.Split(cctx.String("src_buckets"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid src_buckets pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	mapping := make(map[string]string)
+	for _, item := range strings.Split(cctx.String("bucket_map"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(item, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid bucket_map %q, must be src=dst", item)
+		}
+		mapping[from] = to
+	}
+
+	buckets, err := src.ListBuckets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ListBuckets error: %w", err)
+	}
+	var pairs []bucketPair
+	for _, bucket := range buckets {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, bucket.Name); !ok {
+				continue
+			}
+			pair := bucketPair{src: bucket.Name, dst: bucket.Name}
+			if to, ok := mapping[bucket.Name]; ok {
+				pair.dst = to
+			}
+			pairs = append(pairs, pair)
+			break
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no bucket matches src_buckets %q", cctx.String("src_buckets"))
+	}
+	// bucket_map 中写错的源 bucket 会让它迁移到同名的目标 bucket，必须报错
+	for from := range mapping {
+		matched := false
+		for _, pair := range pairs {
+			if pair.src == from {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("bucket_map source bucket %s does not match any bucket of src_buckets", from)
+		}
+	}
+	return pairs, nil
+}
+
+// bucketStats 一对 bucket 的迁移结果
+type bucketStats struct {
+	SrcBucket string `json:"src_bucket"`
+	DstBucket string `json:"dst_bucket"`
+	Copied    int64  `json:"copied"`
+	Bytes     int64  `json:"bytes"`
+	Skipped   int64  `json:"skipped"`
+	Failed    int64  `json:"failed"`
+}
+
+// migrateReport 汇总全部 bucket 的迁移结果，结束时打印，并以 json 写入 report
+type migrateReport struct {
+	mu      sync.Mutex
+	buckets map[bucketPair]*bucketStats
+}
+
+// object 的状态：copied、skipped（目标已存在）、failed
+func (r *migrateReport) add(pair bucketPair, status string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buckets == nil {
+		r.buckets = make(map[bucketPair]*bucketStats)
+	}
+	stats, ok := r.buckets[pair]
+	if !ok {
+		stats = &bucketStats{SrcBucket: pair.src, DstBucket: pair.dst}
+		r.buckets[pair] = stats
+	}
+	switch status {
+	case "copied":
+		stats.Copied++
+		if size > 0 {
+			stats.Bytes += size
+		}
+	case "skipped":
+		stats.Skipped++
+	default:
+		stats.Failed++
+	}
+}
+
+func (r *migrateReport) finish(report string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	total := bucketStats{SrcBucket: "*", DstBucket: "*"}
+	var list []bucketStats
+	for _, stats := range r.buckets {
+		list = append(list, *stats)
+		total.Copied += stats.Copied
+		total.Bytes += stats.Bytes
+		total.Skipped += stats.Skipped
+		total.Failed += stats.Failed
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SrcBucket < list[j].SrcBucket })
+	for _, stats := range append(list, total) {
+		log.Printf("bucket %s -> %s: copied %d (%d bytes), skipped %d, failed %d\n", stats.SrcBucket, stats.DstBucket, stats.Copied, stats.Bytes, stats.Skipped, stats.Failed)
+	}
+	if report == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(struct {
+		Buckets []bucketStats `json:"buckets"`
+		Total   bucketStats   `json:"total"`
+	}{list, total}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(report, append(data, '\n'), 0644)
+}
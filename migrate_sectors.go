@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/go-address"
+	"github.com/minio/minio-go/v7"
+	"github.com/urfave/cli/v2"
+)
+
+var migrateSectors = &cli.Command{
+	Name:  "migrate-sectors",
+	Usage: "s3 to s3 migrate by sector number",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "miner",
+			EnvVars:  []string{"miner"},
+			Required: true,
+			Usage:    "miner address, f01000 or t01000",
+		},
+		&cli.StringFlag{
+			Name:    "sectors",
+			EnvVars: []string{"sectors"},
+			Usage:   "sector numbers to migrate, e.g. 1-100,205",
+		},
+		&cli.BoolFlag{
+			Name:    "from_rpc",
+			EnvVars: []string{"from_rpc"},
+			Usage:   "migrate the sectors declared in src_uuid according to the miner StorageList, intersected with --sectors if set",
+		},
+		&cli.StringFlag{
+			Name:    "PartSize",
+			EnvVars: []string{"PartSize"},
+			Value:   "16MiB",
+		},
+		&cli.UintFlag{
+			Name:    "NumThreads",
+			EnvVars: []string{"NumThreads"},
+			Value:   4,
+		},
+		&cli.BoolFlag{
+			Name:    "EnableMemCache",
+			EnvVars: []string{"EnableMemCache"},
+			Usage:   "after turning it on, it will obviously occupy memory. PartSize*NumThreads",
+		},
+		&cli.BoolFlag{
+			Name:    "DisableMultipart",
+			EnvVars: []string{"DisableMultipart"},
+			Value:   true,
+		},
+		&cli.BoolFlag{
+			Name:    "DisableContentSha256",
+			EnvVars: []string{"DisableContentSha256"},
+			Value:   true,
+		},
+		&cli.IntFlag{
+			Name:    "concurrent",
+			EnvVars: []string{"concurrent"},
+			Value:   10,
+			Usage:   "number of objects copied at the same time",
+		},
+		&cli.IntFlag{
+			Name:    "concurrent_sectors",
+			EnvVars: []string{"concurrent_sectors"},
+			Value:   2,
+			Usage:   "number of sectors migrated at the same time",
+		},
+		&cli.BoolFlag{
+			Name:    "remove",
+			EnvVars: []string{"remove"},
+			Usage:   "delete the sector files in src after the whole sector is migrated and re-declared",
+		},
+		&cli.StringFlag{
+			Name:    "src_uuid",
+			EnvVars: []string{"src_uuid"},
+			Usage:   "src storage uuid",
+		},
+		&cli.StringFlag{
+			Name:    "dst_uuid",
+			EnvVars: []string{"dst_uuid"},
+			Usage:   "dst storage uuid",
+		},
+		&cli.StringFlag{
+			Name:    "rpc",
+			EnvVars: []string{"rpc"},
+			Usage:   "miner rpc, http://localhost:2345/rpc/v0",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			EnvVars: []string{"token"},
+			Usage:   "miner admin token",
+		},
+		&cli.DurationFlag{
+			Name:    "rpc_timeout",
+			EnvVars: []string{"rpc_timeout"},
+			Value:   30 * time.Second,
+			Usage:   "timeout of each miner rpc request",
+		},
+		&cli.IntFlag{
+			Name:    "rpc_retries",
+			EnvVars: []string{"rpc_retries"},
+			Value:   3,
+			Usage:   "retries of miner rpc requests on network errors and 5xx responses",
+		},
+	}, append(append(append(endpointFlags("src", "dst"), bucketFlags("src", "dst")...), credentialFlags("src", "dst")...), sseFlags("src", "dst")...)...),
+	UsageText: `
+src_prefix and dst_prefix are the lotus storage path roots in the buckets, the parent of sealed/cache/unsealed.
+every file of a sector (sealed, cache/*, unsealed, update, update-cache/*) is migrated as one unit.
+StorageDeclareSector/StorageDropSector are only called after all files of the sector are verified on the destination.
+`,
+	Before: remoteBefore("src", "dst"),
+	Action: migrateSectorsAction,
+}
+
+// sectorObject 扇区的一个文件（cache 目录下的每个文件各算一个）
+type sectorObject struct {
+	fileType int
+	key      string
+	size     int64
+}
+
+func migrateSectorsAction(cctx *cli.Context) error {
+	src_bucket := cctx.String("src_bucket")
+	src_prefix := cctx.String("src_prefix")
+	dst_bucket := cctx.String("dst_bucket")
+	dst_prefix := cctx.String("dst_prefix")
+	remove := cctx.Bool("remove")
+
+	PartSize, err := humanize.ParseBytes(cctx.String("PartSize"))
+	if err != nil {
+		return err
+	}
+	putOptions := minio.PutObjectOptions{
+		ServerSideEncryption:  dstSSE,
+		NumThreads:            cctx.Uint("NumThreads"),
+		PartSize:              PartSize,
+		ConcurrentStreamParts: cctx.Bool("EnableMemCache"),
+		DisableMultipart:      cctx.Bool("DisableMultipart"),
+		DisableContentSha256:  cctx.Bool("DisableContentSha256"),
+	}
+
+	addr, err := address.NewFromString(cctx.String("miner"))
+	if err != nil {
+		return err
+	}
+	minerID, err := address.IDFromAddress(addr)
+	if err != nil {
+		return err
+	}
+
+	if cctx.IsSet("src_uuid") || cctx.IsSet("dst_uuid") || cctx.IsSet("rpc") || cctx.IsSet("token") {
+		srcUuid = cctx.String("src_uuid")
+		dstUuid = cctx.String("dst_uuid")
+		rpc := cctx.String("rpc")
+		token := cctx.String("token")
+		if srcUuid == "" || dstUuid == "" || rpc == "" || token == "" {
+			return fmt.Errorf("must srcUuid,dstUuid,rpc,token all set")
+		}
+		lotusApi = newLotusClient(rpc, token, cctx.Duration("rpc_timeout"), cctx.Int("rpc_retries"))
+	}
+
+	ctx := context.Background()
+
+	var sectors []uint64
+	if cctx.IsSet("sectors") {
+		sectors, err = parseSectorRanges(cctx.String("sectors"))
+		if err != nil {
+			return err
+		}
+	}
+	if cctx.Bool("from_rpc") {
+		if lotusApi == nil {
+			return fmt.Errorf("from_rpc requires src_uuid,dst_uuid,rpc,token")
+		}
+		declared, err := declaredSectors(ctx, minerID, srcUuid)
+		if err != nil {
+			return err
+		}
+		if cctx.IsSet("sectors") {
+			sectors = intersectSectors(sectors, declared)
+		} else {
+			sectors = declared
+		}
+	}
+	if len(sectors) == 0 {
+		return fmt.Errorf("no sectors to migrate, set --sectors or --from_rpc")
+	}
+
+	src_endpoint, srcOptions, err := newS3Options(cctx, "src")
+	if err != nil {
+		return err
+	}
+	dst_endpoint, dstOptions, err := newS3Options(cctx, "dst")
+	if err != nil {
+		return err
+	}
+	src, err := minio.New(src_endpoint, srcOptions)
+	if err != nil {
+		return err
+	}
+	dst, err := minio.New(dst_endpoint, dstOptions)
+	if err != nil {
+		return err
+	}
+
+	// 所有扇区共用同一个对象复制并发限制
+	objectCh := make(chan struct{}, cctx.Int("concurrent"))
+	sectorCh := make(chan struct{}, cctx.Int("concurrent_sectors"))
+	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	var failed []uint64
+
+	for _, number := range sectors {
+		wg.Add(1)
+		sectorCh <- struct{}{}
+		go func(number uint64) {
+			defer wg.Done()
+			defer func() {
+				<-sectorCh
+			}()
+
+			sector := sectorID{Miner: minerID, Number: number}
+			name := sector.name()
+			err := migrateSector(ctx, sector, name, src, src_bucket, src_prefix, dst, dst_bucket, dst_prefix, putOptions, objectCh, remove)
+			if err != nil {
+				log.Printf("migrate sector %s failed: %s\n", name, err)
+				failedMu.Lock()
+				failed = append(failed, number)
+				failedMu.Unlock()
+				return
+			}
+			log.Printf("sector %s migrated\n", name)
+		}(number)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i] < failed[j] })
+		return fmt.Errorf("%d sectors failed: %v", len(failed), failed)
+	}
+	return nil
+}
+
+// migrateSector 迁移一个扇区的全部文件，全部在目标端校验通过后才重新声明，最后按需删除源文件
+func migrateSector(ctx context.Context, sector sectorID, name string, src *minio.Client, srcBucket, srcPrefix string, dst *minio.Client, dstBucket, dstPrefix string, putOptions minio.PutObjectOptions, objectCh chan struct{}, remove bool) error {
+	objects, err := resolveSectorObjects(ctx, src, srcBucket, srcPrefix, name)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("no files found in bucket %s", srcBucket)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(objects))
+	for _, obj := range objects {
+		wg.Add(1)
+		objectCh <- struct{}{}
+		go func(obj sectorObject) {
+			defer wg.Done()
+			defer func() {
+				<-objectCh
+			}()
+			if err := copySectorObject(ctx, src, srcBucket, obj, dst, dstBucket, path.Join(dstPrefix, obj.key), putOptions); err != nil {
+				errCh <- fmt.Errorf("copy %s: %w", obj.key, err)
+			}
+		}(obj)
+	}
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return err
+	}
+
+	// 全部文件在目标端校验大小
+	fileTypes := make(map[int]bool)
+	for _, obj := range objects {
+		info, err := dst.StatObject(ctx, dstBucket, path.Join(dstPrefix, obj.key), minio.StatObjectOptions{ServerSideEncryption: dstSSE})
+		if err != nil {
+			return fmt.Errorf("verify %s: %w", obj.key, err)
+		}
+		if info.Size != obj.size {
+			return fmt.Errorf("verify %s: size mismatch: expected %d, got %d", obj.key, obj.size, info.Size)
+		}
+		fileTypes[obj.fileType] = true
+	}
+
+	if lotusApi != nil {
+		for fileType := range fileTypes {
+			file := sectorFile{Sector: sector, FileType: fileType, Name: name, Path: name}
+			if err := changeStorage(ctx, file, srcUuid, dstUuid); err != nil {
+				return err
+			}
+		}
+	}
+
+	if remove {
+		for _, obj := range objects {
+			err := src.RemoveObject(ctx, srcBucket, obj.key, minio.RemoveObjectOptions{})
+			if err != nil {
+				return fmt.Errorf("remove %s: %w", obj.key, err)
+			}
+			log.Printf("remove %s success\n", obj.key)
+		}
+	}
+	return nil
+}
+
+// resolveSectorObjects 找出扇区在各类型目录下的全部文件
+func resolveSectorObjects(ctx context.Context, client *minio.Client, bucket, prefix, name string) ([]sectorObject, error) {
+	var objects []sectorObject
+	for dir, fileType := range sectorFileTypeDirs {
+		key := path.Join(prefix, dir, name)
+		if fileType == ftCache || fileType == ftUpdateCache {
+			for obj := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: key + "/", Recursive: true}) {
+				if obj.Err != nil {
+					return nil, obj.Err
+				}
+				objects = append(objects, sectorObject{fileType: fileType, key: obj.Key, size: obj.Size})
+			}
+			continue
+		}
+
+		info, err := client.StatObject(ctx, bucket, key, minio.StatObjectOptions{ServerSideEncryption: srcSSE})
+		if err != nil {
+			if strings.Contains(err.Error(), "The specified key does not exist.") {
+				continue
+			}
+			return nil, err
+		}
+		objects = append(objects, sectorObject{fileType: fileType, key: key, size: info.Size})
+	}
+	return objects, nil
+}
+
+// copySectorObject 复制单个文件，目标端已存在且大小一致时跳过
+func copySectorObject(ctx context.Context, src *minio.Client, srcBucket string, obj sectorObject, dst *minio.Client, dstBucket, dstKey string, putOptions minio.PutObjectOptions) error {
+	info, err := dst.StatObject(ctx, dstBucket, dstKey, minio.StatObjectOptions{ServerSideEncryption: dstSSE})
+	if err == nil && info.Size == obj.size {
+		log.Printf("object %s already exists in destination bucket %s\n", obj.key, dstBucket)
+		return nil
+	} else if err != nil && !strings.Contains(err.Error(), "The specified key does not exist.") {
+		return err
+	}
+
+	log.Printf("start GetObject %s in bucket %s\n", obj.key, srcBucket)
+	reader, err := src.GetObject(ctx, srcBucket, obj.key, minio.GetObjectOptions{ServerSideEncryption: srcSSE})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	log.Printf("start upload %s to bucket %s\n", dstKey, dstBucket)
+	_, err = dst.PutObject(ctx, dstBucket, dstKey, reader, obj.size, putOptions)
+	if err != nil {
+		return err
+	}
+	log.Printf("object %s copied to destination bucket %s\n", obj.key, dstBucket)
+	return nil
+}
+
+// declaredSectors 从 miner 的 StorageList 中取出 storageID 下属于 miner 的扇区号
+func declaredSectors(ctx context.Context, miner uint64, storageID string) ([]uint64, error) {
+	list, err := lotusApi.StorageList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[uint64]bool)
+	var sectors []uint64
+	for _, decl := range list[storageID] {
+		if decl.Miner != miner || seen[decl.Number] {
+			continue
+		}
+		seen[decl.Number] = true
+		sectors = append(sectors, decl.Number)
+	}
+	sort.Slice(sectors, func(i, j int) bool { return sectors[i] < sectors[j] })
+	return sectors, nil
+}
+
+// maxSectorRanges --sectors 最多展开的扇区数
+const maxSectorRanges = 1000000
+
+// parseSectorRanges 解析 1-100,205 形式的扇区列表，返回去重排序后的扇区号
+func parseSectorRanges(s string) ([]uint64, error) {
+	var total uint64
+	seen := make(map[uint64]bool)
+	var sectors []uint64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := strconv.ParseUint(lo, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sectors %q", part)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.ParseUint(hi, 10, 64)
+			if err != nil || end < start || end == math.MaxUint64 {
+				return nil, fmt.Errorf("invalid sectors %q", part)
+			}
+		}
+		if end-start >= maxSectorRanges-total {
+			return nil, fmt.Errorf("sectors %q expand to more than %d sectors", s, maxSectorRanges)
+		}
+		total += end - start + 1
+		for n := start; n <= end; n++ {
+			if !seen[n] {
+				seen[n] = true
+				sectors = append(sectors, n)
+			}
+		}
+	}
+	sort.Slice(sectors, func(i, j int) bool { return sectors[i] < sectors[j] })
+	return sectors, nil
+}
+
+func intersectSectors(a, b []uint64) []uint64 {
+	in := make(map[uint64]bool, len(b))
+	for _, n := range b {
+		in[n] = true
+	}
+	var out []uint64
+	for _, n := range a {
+		if in[n] {
+			out = append(out, n)
+		}
+	}
+	return out
+}
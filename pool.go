@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 被动健康检查参数：连续失败 poolMaxFailures 次，或统计窗口内错误率超过 poolMaxErrorRate，节点被摘除 poolEjectTime
+const (
+	poolMaxFailures  = 3
+	poolMaxErrorRate = 0.5
+	poolMinRequests  = 10
+	poolWindow       = time.Minute
+	poolEjectTime    = 30 * time.Second
+)
+
+// endpointPool 把请求分发到同一集群的多个节点，节点异常时摘除并换节点重试
+// minio 客户端始终使用第一个 endpoint 的 host，签名用的 Host 头保持不变
+type endpointPool struct {
+	base       *http.Transport
+	host       string
+	scheme     string
+	policy     string
+	dnsRefresh bool
+
+	mu    sync.RWMutex
+	nodes []*poolNode
+	next  uint64
+}
+
+type poolNode struct {
+	// addr 为 host:port；ip 节点通过 dial 指定地址，不改 URL，从而保留 TLS 的 SNI
+	addr      string
+	ip        bool
+	transport http.RoundTripper
+
+	active int64
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+	windowStart  time.Time
+	requests     int
+	errors       int
+}
+
+// newEndpointPool 由逗号分隔的 endpoint 列表创建节点池
+// dnsPool 为 true 时把（第一个）endpoint 的域名解析出的所有 IP 作为节点
+// 每个节点的 Transport 由 base 复制
+func newEndpointPool(endpoints []*url.URL, policy string, dnsPool bool, healthInterval time.Duration, base *http.Transport) (*endpointPool, error) {
+	switch policy {
+	case "round-robin", "least-conn":
+	default:
+		return nil, fmt.Errorf("invalid lb value: %s, must be one of: round-robin, least-conn", policy)
+	}
+
+	p := &endpointPool{
+		base:       base,
+		host:       endpoints[0].Host,
+		scheme:     endpoints[0].Scheme,
+		policy:     policy,
+		dnsRefresh: dnsPool,
+	}
+	for _, u := range endpoints {
+		if u.Scheme != p.scheme {
+			return nil, fmt.Errorf("all endpoints of a pool must use the same scheme")
+		}
+	}
+
+	if dnsPool {
+		if err := p.resolve(); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, u := range endpoints {
+			p.nodes = append(p.nodes, newPoolNode(p.base, u.Host, false))
+		}
+	}
+
+	if healthInterval > 0 {
+		go p.healthLoop(healthInterval)
+	}
+	return p, nil
+}
+
+func newPoolNode(base *http.Transport, addr string, ip bool) *poolNode {
+	t := base.Clone()
+	if ip {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		t.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	return &poolNode{addr: addr, ip: ip, transport: t}
+}
+
+// resolve 解析域名得到节点列表，已有节点保留其状态
+func (p *endpointPool) resolve() error {
+	u := url.URL{Scheme: p.scheme, Host: p.host}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if p.scheme == "https" {
+			port = "443"
+		}
+	}
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", u.Hostname())
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no address found for %s", u.Hostname())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := make(map[string]*poolNode, len(p.nodes))
+	for _, n := range p.nodes {
+		old[n.addr] = n
+	}
+	var nodes []*poolNode
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		if n, ok := old[addr]; ok {
+			nodes = append(nodes, n)
+		} else {
+			nodes = append(nodes, newPoolNode(p.base, addr, true))
+		}
+	}
+	p.nodes = nodes
+	return nil
+}
+
+// pick 选择一个可用节点，exclude 中的节点不参与选择；全部不可用时选择最早恢复的节点
+func (p *endpointPool) pick(exclude map[*poolNode]bool) *poolNode {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	now := time.Now()
+	var available []*poolNode
+	for _, n := range p.nodes {
+		if !exclude[n] && n.healthy(now) {
+			available = append(available, n)
+		}
+	}
+	if len(available) == 0 {
+		var best *poolNode
+		for _, n := range p.nodes {
+			if exclude[n] {
+				continue
+			}
+			if best == nil || n.ejectedAt().Before(best.ejectedAt()) {
+				best = n
+			}
+		}
+		return best
+	}
+
+	if p.policy == "least-conn" {
+		best := available[0]
+		for _, n := range available[1:] {
+			if atomic.LoadInt64(&n.active) < atomic.LoadInt64(&best.active) {
+				best = n
+			}
+		}
+		return best
+	}
+	i := atomic.AddUint64(&p.next, 1)
+	return available[int(i%uint64(len(available)))]
+}
+
+func (p *endpointPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	// 请求体无法重放时只尝试一次
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	tried := make(map[*poolNode]bool)
+	var lastErr error
+	var lastResp *http.Response
+	for {
+		node := p.pick(tried)
+		if node == nil {
+			// 所有节点都返回 5xx 时把最后一个响应交给调用方
+			if lastResp != nil {
+				return lastResp, nil
+			}
+			return nil, lastErr
+		}
+		if lastResp != nil {
+			lastResp.Body.Close()
+			lastResp = nil
+		}
+		tried[node] = true
+
+		outReq := req.Clone(req.Context())
+		if len(tried) > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			outReq.Body = body
+		}
+		if !node.ip {
+			outReq.URL.Host = node.addr
+			outReq.Host = req.URL.Host
+		}
+
+		atomic.AddInt64(&node.active, 1)
+		resp, err := node.transport.RoundTrip(outReq)
+		if err != nil {
+			atomic.AddInt64(&node.active, -1)
+		} else {
+			// 响应体读完或关闭后才算请求结束，大文件下载期间仍计入 least-conn
+			resp.Body = &activeBody{ReadCloser: resp.Body, node: node}
+		}
+
+		if err == nil {
+			// 5xx（如滚动重启时的 502/503）也算节点故障，请求体可重放时换节点重试；501 是功能不支持，换节点没有意义
+			failed := resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented
+			node.report(!failed)
+			if !failed || !replayable || req.Context().Err() != nil {
+				return resp, nil
+			}
+			log.Printf("request to %s returned %s, retry on another node\n", node.addr, resp.Status)
+			lastResp = resp
+			continue
+		}
+		node.report(false)
+		lastErr = err
+		if !replayable || req.Context().Err() != nil {
+			return nil, err
+		}
+		log.Printf("request to %s failed: %s, retry on another node\n", node.addr, err)
+	}
+}
+
+// activeBody 在响应体读到 EOF 或关闭时减少节点的进行中请求数
+type activeBody struct {
+	io.ReadCloser
+	node *poolNode
+	once sync.Once
+}
+
+func (b *activeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *activeBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+func (b *activeBody) done() {
+	b.once.Do(func() { atomic.AddInt64(&b.node.active, -1) })
+}
+
+func (n *poolNode) healthy(now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return now.After(n.ejectedUntil)
+}
+
+func (n *poolNode) ejectedAt() time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ejectedUntil
+}
+
+// report 记录一次请求结果，达到阈值时摘除节点
+func (n *poolNode) report(ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(n.windowStart) > poolWindow {
+		n.windowStart = now
+		n.requests = 0
+		n.errors = 0
+	}
+	n.requests++
+	if ok {
+		n.failures = 0
+		return
+	}
+	n.errors++
+	n.failures++
+
+	rate := float64(n.errors) / float64(n.requests)
+	if n.failures >= poolMaxFailures || (n.requests >= poolMinRequests && rate > poolMaxErrorRate) {
+		if now.After(n.ejectedUntil) {
+			log.Printf("eject node %s for %s, consecutive failures: %d, error rate: %.2f\n", n.addr, poolEjectTime, n.failures, rate)
+		}
+		n.ejectedUntil = now.Add(poolEjectTime)
+		n.failures = 0
+	}
+}
+
+func (n *poolNode) setHealth(ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ok {
+		if !n.ejectedUntil.IsZero() && time.Now().Before(n.ejectedUntil) {
+			log.Printf("node %s is healthy again\n", n.addr)
+		}
+		n.ejectedUntil = time.Time{}
+		n.failures = 0
+		return
+	}
+	if time.Now().After(n.ejectedUntil) {
+		log.Printf("node %s failed health check, eject for %s\n", n.addr, poolEjectTime)
+	}
+	n.ejectedUntil = time.Now().Add(poolEjectTime)
+}
+
+// healthLoop 主动健康检查，同时刷新 DNS 节点列表
+func (p *endpointPool) healthLoop(interval time.Duration) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		time.Sleep(interval)
+		if p.dnsRefresh {
+			if err := p.resolve(); err != nil {
+				log.Printf("resolve %s failed: %s, keep the current nodes\n", p.host, err)
+			}
+		}
+
+		p.mu.RLock()
+		nodes := append([]*poolNode(nil), p.nodes...)
+		p.mu.RUnlock()
+		for _, n := range nodes {
+			go func(n *poolNode) {
+				// 节点能返回 5xx 以外的响应即认为存活，非 MinIO 的 S3 服务会返回 404
+				u := url.URL{Scheme: p.scheme, Host: p.host, Path: "/minio/health/live"}
+				if !n.ip {
+					u.Host = n.addr
+				}
+				req, _ := http.NewRequest(http.MethodGet, u.String(), nil)
+				c := *client
+				c.Transport = n.transport
+				resp, err := c.Do(req)
+				if err != nil {
+					n.setHealth(false)
+					return
+				}
+				resp.Body.Close()
+				n.setHealth(resp.StatusCode < 500)
+			}(n)
+		}
+	}
+}
+
+// parseEndpoints 解析逗号分隔的 endpoint 列表
+func parseEndpoints(s string) ([]*url.URL, error) {
+	var endpoints []*url.URL
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, u)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("endpoint is empty")
+	}
+	return endpoints, nil
+}
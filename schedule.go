@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// 调度策略
+const (
+	scheduleFIFO     = "fifo"
+	scheduleSmallest = "smallest"
+	scheduleLargest  = "largest"
+	scheduleOldest   = "oldest"
+	schedulePriority = "priority"
+)
+
+var schedulePolicies = []string{scheduleFIFO, scheduleSmallest, scheduleLargest, scheduleOldest, schedulePriority}
+
+// scheduler 把列出的对象缓存在最多 window 个对象的窗口中，按 policy 选择下一个派发的对象；
+// concurrent 个 worker 中保留 smallWorkers 个只处理不大于 smallSize 的对象，避免少量大扇区占满全部 worker。
+// 小对象也可以使用普通 worker，大小未知的对象按大对象处理
+type scheduler struct {
+	policy    string
+	window    int
+	smallSize int64
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	small     scheduleHeap
+	large     scheduleHeap
+	seq       int64
+	closed    bool
+	freeAll   int
+	freeSmall int
+}
+
+// scheduleItem 窗口中的一个对象，seq 为列出的顺序，策略相同时先列出的先派发
+type scheduleItem struct {
+	object migrateObject
+	size   int64
+	seq    int64
+}
+
+func newScheduler(policy string, window, concurrent, smallWorkers int, smallSize int64) (*scheduler, error) {
+	if !contains(schedulePolicies, policy) {
+		return nil, fmt.Errorf("invalid schedule %q, must be one of: %s", policy, strings.Join(schedulePolicies, ", "))
+	}
+	if smallWorkers < 0 || smallWorkers >= concurrent {
+		return nil, fmt.Errorf("small_workers must be between 0 and concurrent-1")
+	}
+	if window < 1 {
+		window = 1
+	}
+	s := &scheduler{
+		policy:    policy,
+		window:    window,
+		smallSize: smallSize,
+		freeAll:   concurrent - smallWorkers,
+		freeSmall: smallWorkers,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.small.less = s.less
+	s.large.less = s.less
+	return s, nil
+}
+
+// objectSize 对象大小，文件列表中的对象使用列表中的 size，未知时返回 -1
+func objectSize(object migrateObject) int64 {
+	if object.entry != nil {
+		return object.entry.Size
+	}
+	return object.Size
+}
+
+func (s *scheduler) less(a, b *scheduleItem) bool {
+	switch s.policy {
+	case scheduleSmallest, scheduleLargest:
+		// 大小未知的排在最后
+		if (a.size < 0) != (b.size < 0) {
+			return b.size < 0
+		}
+		if a.size != b.size {
+			if s.policy == scheduleSmallest {
+				return a.size < b.size
+			}
+			return a.size > b.size
+		}
+	case scheduleOldest:
+		if !a.object.LastModified.Equal(b.object.LastModified) {
+			return a.object.LastModified.Before(b.object.LastModified)
+		}
+	case schedulePriority:
+		var pa, pb int
+		if a.object.entry != nil {
+			pa = a.object.entry.Priority
+		}
+		if b.object.entry != nil {
+			pb = b.object.entry.Priority
+		}
+		if pa != pb {
+			return pa > pb
+		}
+	}
+	return a.seq < b.seq
+}
+
+func (s *scheduler) isSmall(item *scheduleItem) bool {
+	return item.size >= 0 && item.size <= s.smallSize
+}
+
+// feed 把 objectsCh 中的对象放入窗口，窗口满时等待，objectsCh 关闭后结束
+func (s *scheduler) feed(objectsCh <-chan migrateObject) {
+	for object := range objectsCh {
+		s.mu.Lock()
+		for s.small.Len()+s.large.Len() >= s.window {
+			s.cond.Wait()
+		}
+		item := &scheduleItem{object: object, size: objectSize(object), seq: s.seq}
+		s.seq++
+		if s.isSmall(item) {
+			heap.Push(&s.small, item)
+		} else {
+			heap.Push(&s.large, item)
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// next 等待一个空闲的 worker 和可以派发的对象，处理完成后必须调用返回的 release。
+// 全部对象都已派发时 ok 为 false
+func (s *scheduler) next() (object migrateObject, release func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		var h *scheduleHeap
+		reserved := false
+		switch {
+		case s.freeAll > 0 && s.small.Len() > 0 && (s.large.Len() == 0 || s.less(s.small.items[0], s.large.items[0])):
+			h = &s.small
+		case s.freeAll > 0 && s.large.Len() > 0:
+			h = &s.large
+		case s.freeSmall > 0 && s.small.Len() > 0:
+			h, reserved = &s.small, true
+		case s.closed && s.small.Len()+s.large.Len() == 0:
+			return migrateObject{}, nil, false
+		default:
+			s.cond.Wait()
+			continue
+		}
+
+		item := heap.Pop(h).(*scheduleItem)
+		if reserved {
+			s.freeSmall--
+		} else {
+			s.freeAll--
+		}
+		s.cond.Broadcast()
+		release = func() {
+			s.mu.Lock()
+			if reserved {
+				s.freeSmall++
+			} else {
+				s.freeAll++
+			}
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		}
+		return item.object, release, true
+	}
+}
+
+type scheduleHeap struct {
+	items []*scheduleItem
+	less  func(a, b *scheduleItem) bool
+}
+
+func (h scheduleHeap) Len() int            { return len(h.items) }
+func (h scheduleHeap) Less(i, j int) bool  { return h.less(h.items[i], h.items[j]) }
+func (h scheduleHeap) Swap(i, j int)       { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *scheduleHeap) Push(x interface{}) { h.items = append(h.items, x.(*scheduleItem)) }
+func (h *scheduleHeap) Pop() interface{} {
+	old := h.items
+	x := old[len(old)-1]
+	h.items = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func scheduleObject(key string, size int64) migrateObject {
+	return migrateObject{ObjectInfo: minio.ObjectInfo{Key: key, Size: size}}
+}
+
+// feedAll 把 objects 全部放入窗口并关闭输入
+func feedAll(s *scheduler, objects ...migrateObject) {
+	ch := make(chan migrateObject, len(objects))
+	for _, object := range objects {
+		ch <- object
+	}
+	close(ch)
+	s.feed(ch)
+}
+
+// nextTimeout 在 timeout 内没有可派发的对象时 ok 为 false
+func nextTimeout(s *scheduler, timeout time.Duration) (migrateObject, func(), bool) {
+	type result struct {
+		object  migrateObject
+		release func()
+		ok      bool
+	}
+	ch := make(chan result, 1)
+	go func() {
+		object, release, ok := s.next()
+		ch <- result{object, release, ok}
+	}()
+	select {
+	case r := <-ch:
+		return r.object, r.release, r.ok
+	case <-time.After(timeout):
+		return migrateObject{}, nil, false
+	}
+}
+
+// drainOrder 逐个派发并立即释放，返回派发顺序
+func drainOrder(s *scheduler) string {
+	var keys []string
+	for {
+		object, release, ok := s.next()
+		if !ok {
+			break
+		}
+		keys = append(keys, object.Key)
+		release()
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestSchedulePolicies(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	objects := func() []migrateObject {
+		a := scheduleObject("a", 300)
+		a.LastModified = base.Add(2 * time.Hour)
+		b := scheduleObject("b", 100)
+		b.LastModified = base
+		c := scheduleObject("c", -1)
+		c.LastModified = base.Add(time.Hour)
+		d := scheduleObject("d", 200)
+		d.LastModified = base.Add(3 * time.Hour)
+		return []migrateObject{a, b, c, d}
+	}
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{scheduleFIFO, "a,b,c,d"},
+		{scheduleSmallest, "b,d,a,c"},
+		{scheduleLargest, "a,d,b,c"},
+		{scheduleOldest, "b,c,a,d"},
+	}
+	for _, tt := range tests {
+		s, err := newScheduler(tt.policy, 100, 1, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		feedAll(s, objects()...)
+		if got := drainOrder(s); got != tt.want {
+			t.Errorf("%s: order = %s, want %s", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestSchedulePriority(t *testing.T) {
+	s, err := newScheduler(schedulePriority, 100, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var objects []migrateObject
+	for _, e := range []struct {
+		key      string
+		priority int
+	}{{"low", -1}, {"none", 0}, {"high", 10}, {"mid", 5}, {"none2", 0}} {
+		entry := &fileEntry{Source: e.key, Size: -1, Priority: e.priority}
+		objects = append(objects, migrateObject{ObjectInfo: minio.ObjectInfo{Key: e.key}, entry: entry})
+	}
+	feedAll(s, objects...)
+	if got, want := drainOrder(s), "high,mid,none,none2,low"; got != want {
+		t.Fatalf("order = %s, want %s", got, want)
+	}
+}
+
+func TestScheduleSmallWorkers(t *testing.T) {
+	// 3 个 worker，其中 1 个只处理不大于 10 字节的对象
+	s, err := newScheduler(scheduleFIFO, 100, 3, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feedAll(s,
+		scheduleObject("large1", 1000),
+		scheduleObject("large2", 1000),
+		scheduleObject("large3", 1000),
+		scheduleObject("unknown", -1),
+		scheduleObject("small1", 5),
+		scheduleObject("small2", 10),
+	)
+
+	// 普通 worker 按顺序处理大对象
+	_, release1, _ := s.next()
+	_, release2, _ := s.next()
+	// 普通 worker 都在忙，保留的 worker 跳过大对象和大小未知的对象，处理小对象
+	object, releaseSmall, ok := nextTimeout(s, time.Second)
+	if !ok || object.Key != "small1" {
+		t.Fatalf("reserved worker got %q, %t, want small1", object.Key, ok)
+	}
+	// 全部 worker 都在忙
+	if object, _, ok := nextTimeout(s, 50*time.Millisecond); ok {
+		t.Fatalf("dispatched %q with no free worker", object.Key)
+	}
+	// 保留的 worker 空闲也不能处理大对象；下一个小对象可以
+	releaseSmall()
+	object, releaseSmall, ok = nextTimeout(s, time.Second)
+	if !ok || object.Key != "small2" {
+		t.Fatalf("reserved worker got %q, %t, want small2", object.Key, ok)
+	}
+	releaseSmall()
+	if object, _, ok := nextTimeout(s, 50*time.Millisecond); ok {
+		t.Fatalf("reserved worker took %q", object.Key)
+	}
+
+	// 普通 worker 空闲后继续处理大对象
+	release1()
+	object, release1, ok = nextTimeout(s, time.Second)
+	if !ok || object.Key != "large3" {
+		t.Fatalf("general worker got %q, %t, want large3", object.Key, ok)
+	}
+	release2()
+	object, release2, ok = nextTimeout(s, time.Second)
+	if !ok || object.Key != "unknown" {
+		t.Fatalf("general worker got %q, %t, want unknown", object.Key, ok)
+	}
+	release1()
+	release2()
+	if _, _, ok := s.next(); ok {
+		t.Fatal("next returned an object after all were dispatched")
+	}
+}
+
+func TestScheduleSmallUsesGeneralWorker(t *testing.T) {
+	s, err := newScheduler(scheduleFIFO, 100, 2, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feedAll(s, scheduleObject("small1", 1), scheduleObject("small2", 1))
+	// 普通 worker 空闲时小对象也使用普通 worker，保留的 worker 留给下一个小对象
+	if object, _, ok := nextTimeout(s, time.Second); !ok || object.Key != "small1" {
+		t.Fatalf("got %q, %t", object.Key, ok)
+	}
+	if object, _, ok := nextTimeout(s, time.Second); !ok || object.Key != "small2" {
+		t.Fatalf("got %q, %t", object.Key, ok)
+	}
+}
+
+func TestScheduleWindow(t *testing.T) {
+	s, err := newScheduler(scheduleSmallest, 2, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan migrateObject)
+	fed := make(chan struct{})
+	go func() {
+		s.feed(ch)
+		close(fed)
+	}()
+	ch <- scheduleObject("c", 3)
+	ch <- scheduleObject("b", 2)
+	// 窗口已满，feed 取走第三个对象后阻塞，不会再从 ch 读取
+	ch <- scheduleObject("a", 1)
+	select {
+	case ch <- scheduleObject("d", 0):
+		t.Fatal("feed accepted an object beyond the window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 只在窗口内排序：a 还没有进入窗口，先派发 b
+	object, release, _ := s.next()
+	if object.Key != "b" {
+		t.Fatalf("first = %q, want b", object.Key)
+	}
+	release()
+	close(ch)
+	select {
+	case <-fed:
+	case <-time.After(time.Second):
+		t.Fatal("feed did not finish")
+	}
+	if got := drainOrder(s); got != "a,c" {
+		t.Fatalf("rest = %s, want a,c", got)
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	if _, err := newScheduler("random", 1, 2, 0, 0); err == nil {
+		t.Error("invalid policy accepted")
+	}
+	if _, err := newScheduler(scheduleFIFO, 1, 2, 2, 0); err == nil {
+		t.Error("small_workers equal to concurrent accepted")
+	}
+}
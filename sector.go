@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/minio/minio-go/v7"
+)
+
+// 与 lotus storiface.SectorFileType 一致
+const (
+	ftUnsealed = 1 << iota
+	ftSealed
+	ftCache
+	ftUpdate
+	ftUpdateCache
+)
+
+// lotus 存储路径下各类扇区文件所在的目录
+var sectorFileTypeDirs = map[string]int{
+	"unsealed":     ftUnsealed,
+	"sealed":       ftSealed,
+	"cache":        ftCache,
+	"update":       ftUpdate,
+	"update-cache": ftUpdateCache,
+}
+
+// sectorFile 由 object key 解析出的扇区文件
+type sectorFile struct {
+	Sector   sectorID
+	FileType int
+	// Name 为 s-f01000-1 形式的扇区文件名
+	Name string
+	// Path 为扇区文件（cache/update-cache 为目录）在 bucket 中的 key，目录以 / 结尾
+	Path string
+}
+
+// isDir cache 和 update-cache 是包含多个文件的目录
+func (f sectorFile) isDir() bool {
+	return f.FileType == ftCache || f.FileType == ftUpdateCache
+}
+
+var sectorKeyRe = regexp.MustCompile(`(^|/)(?:(unsealed|sealed|cache|update|update-cache)/)?(s-([ft]0\d+)-(\d+))(/|$)`)
+
+// parseSectorKey 从 object key 解析扇区和文件类型，支持 f/t 两种地址前缀
+// key 中没有 unsealed/sealed/cache/update/update-cache 目录时按 unsealed 处理，与之前的行为一致
+func parseSectorKey(key string) (sectorFile, error) {
+	loc := sectorKeyRe.FindStringSubmatchIndex(key)
+	if loc == nil {
+		return sectorFile{}, fmt.Errorf("to abi.SectorID failed, %s is not a sector file", key)
+	}
+	group := func(i int) string {
+		if loc[2*i] < 0 {
+			return ""
+		}
+		return key[loc[2*i]:loc[2*i+1]]
+	}
+
+	addr, err := address.NewFromString(group(4))
+	if err != nil {
+		return sectorFile{}, err
+	}
+	mid, err := address.IDFromAddress(addr)
+	if err != nil {
+		return sectorFile{}, err
+	}
+	snum, err := strconv.ParseUint(group(5), 10, 64)
+	if err != nil {
+		return sectorFile{}, err
+	}
+
+	file := sectorFile{
+		Sector:   sectorID{Miner: mid, Number: snum},
+		FileType: ftUnsealed,
+		Name:     group(3),
+		Path:     key[:loc[7]],
+	}
+	if dir := group(2); dir != "" {
+		file.FileType = sectorFileTypeDirs[dir]
+	}
+	if file.isDir() {
+		file.Path += "/"
+	}
+	return file, nil
+}
+
+// declaredDirs 记录已经重新声明过的 cache 目录，同一目录只声明一次
+var declaredDirs = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+func claimSectorDir(dir string) bool {
+	declaredDirs.Lock()
+	defer declaredDirs.Unlock()
+	if declaredDirs.m[dir] {
+		return false
+	}
+	declaredDirs.m[dir] = true
+	return true
+}
+
+// sectorDirMigrated 检查源端目录下仍存在的每个文件在目标端是否都已存在且原始内容大小一致
+// 开启 remove 时已迁移的文件会从源端删除，剩下的文件都已到达目标端即视为迁移完成
+func sectorDirMigrated(ctx context.Context, src *minio.Client, srcBucket, dir string, dst *minio.Client, dstBucket, dstPrefix string) (bool, error) {
+	for obj := range src.ListObjects(ctx, srcBucket, minio.ListObjectsOptions{Prefix: dir, Recursive: true}) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		info, err := dst.StatObject(ctx, dstBucket, path.Join(dstPrefix, obj.Key), minio.StatObjectOptions{ServerSideEncryption: dstSSE})
+		if err != nil {
+			if strings.Contains(err.Error(), "The specified key does not exist.") {
+				return false, nil
+			}
+			return false, err
+		}
+		// 目标端可能压缩、加密过，比较两端原始内容的大小
+		size := plainSize(info, dstCSE)
+		if size < 0 {
+			return false, nil
+		}
+		if size != csePlainSize(srcCSE, obj.Size) {
+			// 列举结果没有 metadata，源端对象本身可能是压缩过的
+			srcInfo, err := src.StatObject(ctx, srcBucket, obj.Key, minio.StatObjectOptions{ServerSideEncryption: srcSSE})
+			if err != nil {
+				return false, err
+			}
+			if plainSize(srcInfo, srcCSE) != size {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// sectorDirExported 检查源端目录下的每个文件是否都已导出到本地 root 下且大小一致
+func sectorDirExported(ctx context.Context, src *minio.Client, srcBucket, dir string, root string) (bool, error) {
+	for obj := range src.ListObjects(ctx, srcBucket, minio.ListObjectsOptions{Prefix: dir, Recursive: true}) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		localPath, err := exportPath(root, obj.Key)
+		if err != nil {
+			return false, err
+		}
+		stat, err := os.Stat(localPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		if stat.Size() != csePlainSize(srcCSE, obj.Size) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
-	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -12,58 +12,32 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/urfave/cli/v2"
 )
 
 var upload = &cli.Command{
 	Name:  "upload",
 	Usage: "upload local file to s3",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:    "dir",
 			EnvVars: []string{"dir"},
 		},
 		&cli.StringFlag{
-			Name:     "dst_endpoint",
-			EnvVars:  []string{"dst_endpoint"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_ak",
-			EnvVars:  []string{"dst_ak"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_sk",
-			EnvVars:  []string{"dst_sk"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_bucket",
-			EnvVars:  []string{"dst_bucket"},
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:     "dst_region",
-			EnvVars:  []string{"dst_region"},
-			Required: false,
-			Hidden:   true,
-		},
-		&cli.StringFlag{
-			Name:    "dst_prefix",
-			EnvVars: []string{"dst_prefix"},
+			Name:    "filelist",
+			EnvVars: []string{"filelist"},
+			Usage:   "specify the list to be uploaded, one path per line. - reads stdin, s3://bucket/key reads from the dst endpoint",
 		},
 		&cli.StringFlag{
-			Name:    "dst_bucket_lookup",
-			EnvVars: []string{"dst_bucket_lookup"},
+			Name:    "filelist_format",
+			EnvVars: []string{"filelist_format"},
 			Value:   "auto",
-			Usage:   "bucket lookup type: dns, path, auto",
+			Usage:   "filelist format: plain, csv, jsonl, auto (by file extension)",
 		},
 		&cli.StringFlag{
-			Name:    "filelist",
-			EnvVars: []string{"filelist"},
-			Usage:   "specify the list to be downloaded, one url per line",
+			Name:    "failed_list",
+			EnvVars: []string{"failed_list"},
+			Usage:   "write the entries that failed checksum or size verification to this file, in jsonl format",
 		},
 		&cli.StringFlag{
 			Name:    "PartSize",
@@ -95,14 +69,19 @@ var upload = &cli.Command{
 			EnvVars: []string{"concurrent"},
 			Value:   10,
 		},
-	},
+		&cli.StringFlag{
+			Name:    "compress",
+			EnvVars: []string{"compress"},
+			Usage:   "compress objects whose key matches the pattern before sending, pattern=codec separated by comma, codec: zstd, gzip, e.g. *.log=zstd,*.json=gzip",
+		},
+	}, append(append(append(append(endpointFlags("dst"), bucketFlags("dst")...), credentialFlags("dst")...), sseFlags("dst")...), cseFlags("dst")...)...),
+	Before: remoteBefore("dst"),
 	Action: uploadAction,
 }
 
 func uploadAction(cctx *cli.Context) error {
 
 	dst_bucket := cctx.String("dst_bucket")
-	dst_region := cctx.String("dst_region")
 	dst_prefix := cctx.String("dst_prefix")
 	if cctx.IsSet("dir") && cctx.IsSet("filelist") {
 		return fmt.Errorf("only be specified dir or filelist")
@@ -116,32 +95,14 @@ func uploadAction(cctx *cli.Context) error {
 	ConcurrentStreamParts := cctx.Bool("EnableMemCache")
 	DisableMultipart := cctx.Bool("DisableMultipart")
 	DisableContentSha256 := cctx.Bool("DisableContentSha256")
-	disableLookupDomain = cctx.Bool("disable_lookup")
-
-	parsedDst, err := url.Parse(cctx.String("dst_endpoint"))
+	compressRules, err := parseCompressRules(cctx.String("compress"))
 	if err != nil {
 		return err
 	}
-	dst_endpoint := parsedDst.Host
-	dst_ssl := parsedDst.Scheme == "https"
-	dstOptions := &minio.Options{
-		Creds:     credentials.NewStaticV4(cctx.String("dst_ak"), cctx.String("dst_sk"), ""),
-		Secure:    dst_ssl,
-		Region:    dst_region,
-		Transport: transport,
-	}
 
-	// Set bucket lookup type based on the flag
-	bucketLookup := cctx.String("dst_bucket_lookup")
-	switch bucketLookup {
-	case "dns":
-		dstOptions.BucketLookup = minio.BucketLookupDNS
-	case "path":
-		dstOptions.BucketLookup = minio.BucketLookupPath
-	case "auto":
-		dstOptions.BucketLookup = minio.BucketLookupAuto
-	default:
-		return fmt.Errorf("invalid bucket_lookup value: %s, must be one of: dns, path, auto", bucketLookup)
+	dst_endpoint, dstOptions, err := newS3Options(cctx, "dst")
+	if err != nil {
+		return err
 	}
 
 	ctx := context.Background()
@@ -150,32 +111,22 @@ func uploadAction(cctx *cli.Context) error {
 	// Create a buffered channel to manage the number of workers.
 	workerCh := make(chan struct{}, cctx.Int("concurrent"))
 
-	var lines []string
-	if cctx.IsSet("dir") {
-		lines, err = listFiles(cctx.String("dir"))
-		if err != nil {
-			return err
-		}
-	} else if cctx.IsSet("filelist") {
-		content, err := os.ReadFile(cctx.String("filelist"))
-		if err != nil {
-			log.Fatal(err)
-		}
-		lines = strings.Split(strings.TrimSpace(string(content)), "\n")
-	}
-
-	for _, key := range lines {
+	var failed failedEntries
+	dispatch := func(entry fileEntry) error {
 		// Start a new worker.
 		wg.Add(1)
 		workerCh <- struct{}{} // Add to the worker queue.
-		go func(key string) {
+		go func(entry fileEntry) {
 			defer wg.Done()
 			defer func() {
 				<-workerCh // Remove from the worker queue.
 			}()
+			key := entry.Source
 
 			var objectName string
-			if string(key[0]) == "/" {
+			if entry.Dest != "" {
+				objectName = path.Join(dst_prefix, entry.Dest)
+			} else if string(key[0]) == "/" {
 				objectName = path.Join(dst_prefix, key[1:])
 			} else {
 				objectName = path.Join(dst_prefix, key)
@@ -189,7 +140,7 @@ func uploadAction(cctx *cli.Context) error {
 
 			// Check if object already exists in the destination bucket.
 			log.Printf("start StatObject %s in bucket %s\n", objectName, dst_bucket)
-			_, err = dst.StatObject(ctx, dst_bucket, objectName, minio.StatObjectOptions{})
+			_, err = dst.StatObject(ctx, dst_bucket, objectName, minio.StatObjectOptions{ServerSideEncryption: dstSSE})
 			if err == nil {
 				log.Printf("object %s already exists in destination bucket %s\n", key, dst_bucket)
 				return
@@ -198,18 +149,94 @@ func uploadAction(cctx *cli.Context) error {
 				return
 			}
 
+			putOptions := minio.PutObjectOptions{ServerSideEncryption: dstSSE, UserMetadata: entry.Metadata, UserTags: entry.Tags, NumThreads: NumThreads, PartSize: PartSize, ConcurrentStreamParts: ConcurrentStreamParts, DisableMultipart: DisableMultipart, DisableContentSha256: DisableContentSha256}
+
+			// 不需要校验、压缩和加密时直接使用 FPutObject
+			codec := matchCompress(compressRules, objectName)
+			if entry.digest == nil && entry.Size < 0 && codec == "" && dstCSE == nil {
+				log.Printf("start upload %s to bucket %s\n", key, dst_bucket)
+				_, err = dst.FPutObject(ctx, dst_bucket, objectName, key, putOptions)
+				if err != nil {
+					log.Println("FPutObject error:", err)
+					return
+				}
+				log.Printf("object %s upload to destination bucket %s\n", key, dst_bucket)
+				return
+			}
+
+			file, err := os.Open(key)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			defer file.Close()
+			stat, err := file.Stat()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if entry.Size >= 0 && stat.Size() != entry.Size {
+				log.Printf("verify %s failed: size mismatch: expected %d, got %d\n", key, entry.Size, stat.Size())
+				failed.add(entry)
+				return
+			}
+
+			// 边上传边计算校验值，压缩、客户端加密时校验的是原始内容
+			verifier := newVerifyWriter(entry.digest, entry.Size)
+			var body io.Reader = io.TeeReader(file, verifier)
+			encoded, size, metadata, err := encodeObject(body, stat.Size(), objectName, compressRules, putOptions.UserMetadata)
+			if err != nil {
+				log.Printf("encode %s failed: %s\n", key, err)
+				return
+			}
+			defer encoded.Close()
+			body, putOptions.UserMetadata = encoded, metadata
+			// 压缩后大小未知，minio-go 要求使用分片上传
+			putOptions.DisableMultipart = putOptions.DisableMultipart && size >= 0
 			log.Printf("start upload %s to bucket %s\n", key, dst_bucket)
-			_, err = dst.FPutObject(ctx, dst_bucket, objectName, key, minio.PutObjectOptions{NumThreads: NumThreads, PartSize: PartSize, ConcurrentStreamParts: ConcurrentStreamParts, DisableMultipart: DisableMultipart, DisableContentSha256: DisableContentSha256})
+			_, err = dst.PutObject(ctx, dst_bucket, objectName, body, size, putOptions)
 			if err != nil {
-				log.Println("FPutObject error:", err)
+				log.Println("PutObject error:", err)
+				return
+			}
+			if err := verifier.Verify(); err != nil {
+				log.Printf("verify %s failed: %s\n", key, err)
+				failed.add(entry)
+				err = dst.RemoveObject(ctx, dst_bucket, objectName, minio.RemoveObjectOptions{})
+				if err != nil {
+					log.Println("RemoveObject error:", err)
+				}
 				return
 			}
 			log.Printf("object %s upload to destination bucket %s\n", key, dst_bucket)
 
-		}(key)
+		}(entry)
+		return nil
+	}
+
+	if cctx.IsSet("dir") {
+		var files []string
+		files, err = listFiles(cctx.String("dir"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			dispatch(fileEntry{Source: file, Size: -1})
+		}
+	} else if cctx.IsSet("filelist") {
+		var dst *minio.Client
+		dst, err = minio.New(dst_endpoint, dstOptions)
+		if err != nil {
+			return err
+		}
+		err = readFilelist(ctx, dst, cctx.String("filelist"), cctx.String("filelist_format"), false, dispatch)
 	}
 
 	// Wait for all workers to finish.
 	wg.Wait()
-	return nil
+	if err != nil {
+		return err
+	}
+
+	return failed.finish(cctx.String("failed_list"))
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/urfave/cli/v2"
+)
+
+// 源对象的版本 id 记录在目标对象的 metadata 中
+const versionMetaSource = "S3tools-Source-Version-Id"
+
+// migrateVersions 按版本迁移：
+// all_versions 把每个 key 的全部版本（包括删除标记）按时间顺序在开启了版本控制的目标上重放，
+// 目标上已有 n 个版本时认为前 n 个版本已经重放过，从第 n+1 个版本继续；
+// version_id 只迁移该版本，覆盖目标上的同名对象，用于恢复到某个时间点的内容
+func migrateVersions(ctx context.Context, cctx *cli.Context, src, dst *minio.Client, putOptions minio.PutObjectOptions, compressRules []compressRule) error {
+	src_bucket := cctx.String("src_bucket")
+	src_prefix := cctx.String("src_prefix")
+	dst_bucket := cctx.String("dst_bucket")
+	dst_prefix := cctx.String("dst_prefix")
+	versionID := cctx.String("version_id")
+
+	if cctx.Bool("all_versions") {
+		versioning, err := dst.GetBucketVersioning(ctx, dst_bucket)
+		if err != nil {
+			return err
+		}
+		if !versioning.Enabled() {
+			return fmt.Errorf("versioning of dst bucket %s must be enabled for all_versions", dst_bucket)
+		}
+	}
+
+	// A wait group to manage the number of active goroutines.
+	var wg sync.WaitGroup
+	// Create a buffered channel to manage the number of workers.
+	workerCh := make(chan struct{}, cctx.Int("concurrent"))
+
+	dispatch := func(versions []minio.ObjectInfo) {
+		// Start a new worker.
+		wg.Add(1)
+		workerCh <- struct{}{} // Add to the worker queue.
+		go func(versions []minio.ObjectInfo) {
+			defer wg.Done()
+			defer func() {
+				<-workerCh // Remove from the worker queue.
+			}()
+
+			key := versions[0].Key
+			dstKey := path.Join(dst_prefix, key)
+			if versionID != "" {
+				if versions[0].IsDeleteMarker {
+					log.Printf("version %s of %s is a delete marker, skip\n", versionID, key)
+					return
+				}
+				if err := copyVersion(ctx, src, src_bucket, versions[0], dst, dst_bucket, dstKey, putOptions, compressRules); err != nil {
+					log.Printf("copy %s version %s failed: %s\n", key, versionID, err)
+					return
+				}
+				log.Printf("object %s version %s copied to destination bucket %s\n", key, versionID, dst_bucket)
+				return
+			}
+
+			// 列出的版本从新到旧，重放时从旧到新。LastModified 只精确到秒，不能按时间排序
+			for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+				versions[i], versions[j] = versions[j], versions[i]
+			}
+			replayed := 0
+			for obj := range dst.ListObjects(ctx, dst_bucket, minio.ListObjectsOptions{Prefix: dstKey, WithVersions: true}) {
+				if obj.Err != nil {
+					log.Println("ListObjects error:", obj.Err)
+					return
+				}
+				if obj.Key == dstKey {
+					replayed++
+				}
+			}
+			if replayed >= len(versions) {
+				log.Printf("all %d versions of %s already exist in destination bucket %s\n", len(versions), key, dst_bucket)
+				return
+			}
+
+			// 版本必须按顺序重放，某个版本失败时停止这个 key，下次运行从失败的版本继续
+			for _, version := range versions[replayed:] {
+				if version.IsDeleteMarker {
+					err := dst.RemoveObject(ctx, dst_bucket, dstKey, minio.RemoveObjectOptions{})
+					if err != nil {
+						log.Printf("replay delete marker %s of %s failed: %s\n", version.VersionID, key, err)
+						return
+					}
+					continue
+				}
+				if err := copyVersion(ctx, src, src_bucket, version, dst, dst_bucket, dstKey, putOptions, compressRules); err != nil {
+					log.Printf("copy %s version %s failed: %s\n", key, version.VersionID, err)
+					return
+				}
+			}
+			log.Printf("%d versions of %s replayed to destination bucket %s\n", len(versions)-replayed, key, dst_bucket)
+		}(versions)
+	}
+
+	// 同一个 key 的版本在列表中是连续的
+	var err error
+	var versions []minio.ObjectInfo
+	for obj := range src.ListObjects(ctx, src_bucket, minio.ListObjectsOptions{Prefix: src_prefix, Recursive: true, WithVersions: true}) {
+		if obj.Err != nil {
+			err = fmt.Errorf("ListObjects error: %w", obj.Err)
+			break
+		}
+		if versionID != "" {
+			if obj.VersionID == versionID {
+				dispatch([]minio.ObjectInfo{obj})
+			}
+			continue
+		}
+		if len(versions) > 0 && versions[0].Key != obj.Key {
+			dispatch(versions)
+			versions = nil
+		}
+		versions = append(versions, obj)
+	}
+	if err == nil && len(versions) > 0 {
+		dispatch(versions)
+	}
+
+	// Wait for all workers to finish.
+	wg.Wait()
+	return err
+}
+
+// copyVersion 复制源对象的一个版本，在目标上生成一个新版本
+func copyVersion(ctx context.Context, src *minio.Client, srcBucket string, version minio.ObjectInfo, dst *minio.Client, dstBucket, dstKey string, putOptions minio.PutObjectOptions, compressRules []compressRule) error {
+	reader, err := src.GetObject(ctx, srcBucket, version.Key, minio.GetObjectOptions{ServerSideEncryption: srcSSE, VersionID: version.VersionID})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	info, err := reader.Stat()
+	if err != nil {
+		return err
+	}
+
+	decoded, size, err := decodeObject(reader, info)
+	if err != nil {
+		return err
+	}
+	defer decoded.Close()
+	encoded, size, metadata, err := encodeObject(decoded, size, dstKey, compressRules, map[string]string{versionMetaSource: version.VersionID})
+	if err != nil {
+		return err
+	}
+	defer encoded.Close()
+
+	putOptions.UserMetadata = metadata
+	// 压缩后大小未知，minio-go 要求使用分片上传
+	putOptions.DisableMultipart = putOptions.DisableMultipart && size >= 0
+	_, err = dst.PutObject(ctx, dstBucket, dstKey, encoded, size, putOptions)
+	return err
+}